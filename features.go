@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redhatinsights/rhc-worker-playbook/internal/ansible"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/config"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/constants"
+	"github.com/redhatinsights/yggdrasil/worker"
+)
+
+// Keys of the worker's features map, which advertises to the server what the
+// worker is able to run.
+const (
+	featureVersion         = "version"
+	featureAnsibleCore     = "ansible-core"
+	featureAnsibleRunner   = "ansible-runner"
+	featureCollections     = "collections"
+	featureVerifyPlaybook  = "verify-playbook"
+	featureMetadataKeys    = "metadata-keys"
+	featureMessageVersions = "message-versions"
+)
+
+// metadataKeys lists the message metadata keys read by rx.
+var metadataKeys = []string{
+	"return_url",
+	"crc_dispatcher_correlation_id",
+	"response_interval",
+	"timeout",
+	"check_mode",
+	"diff",
+	"crc_message_version",
+	"event_preset",
+	"event_include",
+	"event_exclude",
+	"extra_vars",
+	"accept_encoding",
+}
+
+// collectionsPath is the directory ansible-runner loads collections from.
+var collectionsPath = filepath.Join(
+	constants.DataDir,
+	"rhc-worker-playbook",
+	"ansible",
+	"collections",
+	"ansible_collections",
+)
+
+// featuresLock serializes the updates of the worker's features map, which may
+// be refreshed by several messages at once.
+var featuresLock sync.Mutex
+
+// detectFeatures returns the worker's features map. Facts that cannot be
+// detected are logged and advertised as empty values.
+func detectFeatures() map[string]string {
+	versions, err := pythonPackageVersions("ansible-core", "ansible-runner")
+	if err != nil {
+		slog.Warn("cannot detect ansible versions:", "err", err)
+	}
+
+	collections, err := installedCollections(collectionsPath)
+	if err != nil {
+		slog.Warn("cannot detect installed collections:", "err", err)
+	}
+
+	messageVersions := make([]string, 0, len(ansible.MessageVersions))
+	for _, version := range ansible.MessageVersions {
+		messageVersions = append(messageVersions, strconv.Itoa(version))
+	}
+
+	return map[string]string{
+		featureVersion:         constants.Version,
+		featureAnsibleCore:     versions["ansible-core"],
+		featureAnsibleRunner:   versions["ansible-runner"],
+		featureCollections:     strings.Join(collections, ","),
+		featureVerifyPlaybook:  strconv.FormatBool(config.DefaultConfig.VerifyPlaybook),
+		featureMetadataKeys:    strings.Join(metadataKeys, ","),
+		featureMessageVersions: strings.Join(messageVersions, ","),
+	}
+}
+
+// refreshFeatures detects the worker's features again and updates those that
+// changed, such as when a playbook upgraded ansible-core or installed a
+// collection. It does nothing if there is no worker.
+func refreshFeatures(w *worker.Worker) {
+	if w == nil {
+		return
+	}
+
+	featuresLock.Lock()
+	defer featuresLock.Unlock()
+
+	for name, value := range detectFeatures() {
+		if w.GetFeature(name) == value {
+			continue
+		}
+		slog.Info("feature changed:", "name", name, "value", value)
+		if err := w.SetFeature(name, value); err != nil {
+			slog.Error("cannot set feature:", "name", name, "err", err)
+		}
+	}
+}
+
+// pythonPackageVersions returns the installed version of each of the named
+// Python distributions, as seen by the interpreter that runs ansible-runner.
+// Distributions that are not installed are left out.
+func pythonPackageVersions(names ...string) (map[string]string, error) {
+	script := `
+import sys
+from importlib import metadata
+for name in sys.argv[1:]:
+    try:
+        print(name, metadata.version(name))
+    except metadata.PackageNotFoundError:
+        pass
+`
+	cmd := exec.Command(constants.Python3Path, append([]string{"-c", script}, names...)...)
+	cmd.Env = []string{
+		"PATH=/sbin:/bin:/usr/sbin:/usr/bin",
+		"PYTHONPATH=" + filepath.Join(constants.LibDir, "rhc-worker-playbook"),
+		"PYTHONDONTWRITEBYTECODE=1",
+	}
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot run python3: err=%w stderr=%v", err, stderr.String())
+	}
+
+	versions := map[string]string{}
+	for line := range strings.Lines(string(output)) {
+		name, version, found := strings.Cut(strings.TrimSpace(line), " ")
+		if found {
+			versions[name] = version
+		}
+	}
+	return versions, nil
+}
+
+// installedCollections returns the collections installed in dir, an
+// ansible_collections directory, as sorted "namespace.name:version" strings.
+// Collections whose manifest cannot be read are logged and left out.
+func installedCollections(dir string) ([]string, error) {
+	manifests, err := filepath.Glob(filepath.Join(dir, "*", "*", "MANIFEST.json"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot find collections: err=%w", err)
+	}
+
+	collections := []string{}
+	for _, path := range manifests {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Warn("cannot read collection manifest:", "path", path, "err", err)
+			continue
+		}
+		var manifest struct {
+			CollectionInfo struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+				Version   string `json:"version"`
+			} `json:"collection_info"`
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			slog.Warn("cannot unmarshal collection manifest:", "path", path, "err", err)
+			continue
+		}
+		info := manifest.CollectionInfo
+		if info.Namespace == "" || info.Name == "" {
+			slog.Warn("collection manifest has no namespace or name:", "path", path)
+			continue
+		}
+		collections = append(collections, fmt.Sprintf("%v.%v:%v", info.Namespace, info.Name, info.Version))
+	}
+	slices.Sort(collections)
+
+	return collections, nil
+}
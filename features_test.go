@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInstalledCollections(t *testing.T) {
+	tests := []struct {
+		description string
+		manifests   map[string]string
+		want        []string
+	}{
+		{
+			description: "no collections",
+			want:        []string{},
+		},
+		{
+			description: "sorted collections",
+			manifests: map[string]string{
+				"community/general": `{"collection_info":{"namespace":"community","name":"general","version":"12.6.2"}}`,
+				"ansible/posix":     `{"collection_info":{"namespace":"ansible","name":"posix","version":"2.2.1"}}`,
+			},
+			want: []string{"ansible.posix:2.2.1", "community.general:12.6.2"},
+		},
+		{
+			description: "invalid manifests",
+			manifests: map[string]string{
+				"ansible/posix":     `{`,
+				"community/crypto":  `{"collection_info":{}}`,
+				"community/general": `{"collection_info":{"namespace":"community","name":"general","version":"12.6.2"}}`,
+			},
+			want: []string{"community.general:12.6.2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir := t.TempDir()
+			for collection, manifest := range test.manifests {
+				if err := os.MkdirAll(filepath.Join(dir, collection), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, collection, "MANIFEST.json"), []byte(manifest), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := installedCollections(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("\ngot:\n%v\nwant:\n%v", got, test.want)
+			}
+		})
+	}
+}
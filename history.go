@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redhatinsights/rhc-worker-playbook/internal/ansible"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/config"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/constants"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/history"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/redact"
+	"github.com/urfave/cli/v2"
+)
+
+const flagNameEvents = "events"
+
+// listRunsCommand lists the runs recorded in the run history.
+var listRunsCommand = &cli.Command{
+	Name:   "list-runs",
+	Usage:  "list the messages processed by the worker",
+	Action: listRunsAction,
+}
+
+// showRunCommand describes a run recorded in the run history.
+var showRunCommand = &cli.Command{
+	Name:      "show-run",
+	Usage:     "describe a message processed by the worker",
+	ArgsUsage: "ID",
+	Description: "Describes the run of the message whose message ID or correlation " +
+		"ID is ID, optionally printing the job events written by ansible-runner, " +
+		"one per line, with sensitive data masked.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  flagNameEvents,
+			Usage: "print the job events of the run",
+		},
+	},
+	Action: showRunAction,
+}
+
+// openHistory loads the configuration and opens the run history.
+func openHistory(ctx *cli.Context) (*history.Store, error) {
+	loadConfigFromContext(ctx)
+	level, err := parseLevel(config.DefaultConfig.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetLogLoggerLevel(level)
+
+	return history.Open(filepath.Join(constants.StateDir, "history"))
+}
+
+func listRunsAction(ctx *cli.Context) error {
+	store, err := openHistory(ctx)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	runs, err := store.List()
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	writeRuns(os.Stdout, runs)
+
+	return nil
+}
+
+func showRunAction(ctx *cli.Context) error {
+	store, err := openHistory(ctx)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if ctx.NArg() != 1 {
+		return cli.Exit("usage: show-run ID", 1)
+	}
+
+	run, err := store.Get(ctx.Args().First())
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	writeRun(os.Stdout, run)
+
+	if !ctx.Bool(flagNameEvents) {
+		return nil
+	}
+
+	// Job events are stored as written by ansible-runner, so mask them the
+	// same way as transmitted events.
+	eventRedactor, err := redact.New(config.DefaultConfig.RedactPatterns)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	events, err := ansible.ReadJobEvents(run.CorrelationID)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	for _, event := range events {
+		var data map[string]any
+		if err := json.Unmarshal(event, &data); err != nil {
+			slog.Warn("cannot unmarshal job event:", "err", err)
+			continue
+		}
+		eventRedactor.Event(data)
+		redacted, err := json.Marshal(data)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot marshal job event: %w", err), 1)
+		}
+		fmt.Println(string(redacted))
+	}
+
+	return nil
+}
+
+// writeRuns writes a table summarizing runs to w.
+func writeRuns(w io.Writer, runs []history.Run) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STARTED\tMESSAGE ID\tCORRELATION ID\tSTATUS\tERROR\tTRANSMIT")
+	for _, run := range runs {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			run.Started.Local().Format(time.DateTime),
+			run.MessageID,
+			run.CorrelationID,
+			valueOrNone(run.Status),
+			valueOrNone(run.ErrorKey),
+			valueOrNone(run.TransmitOutcome),
+		)
+	}
+	tw.Flush()
+}
+
+// writeRun writes a human readable description of run to w.
+func writeRun(w io.Writer, run history.Run) {
+	finished := "(none)"
+	if !run.Finished.IsZero() {
+		finished = run.Finished.Local().Format(time.RFC3339)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "message ID:\t%v\n", run.MessageID)
+	fmt.Fprintf(tw, "correlation ID:\t%v\n", run.CorrelationID)
+	fmt.Fprintf(tw, "return URL:\t%v\n", valueOrNone(run.ReturnURL))
+	fmt.Fprintf(tw, "playbook SHA-256:\t%v\n", run.PlaybookSHA256)
+	fmt.Fprintf(tw, "verification:\t%v\n", valueOrNone(run.Verification))
+	fmt.Fprintf(tw, "signing keys:\t%v\n", valueOrNone(strings.Join(run.SigningKeys, ", ")))
+	fmt.Fprintf(tw, "started:\t%v\n", run.Started.Local().Format(time.RFC3339))
+	fmt.Fprintf(tw, "finished:\t%v\n", finished)
+	fmt.Fprintf(tw, "status:\t%v\n", valueOrNone(run.Status))
+	fmt.Fprintf(tw, "error key:\t%v\n", valueOrNone(run.ErrorKey))
+	fmt.Fprintf(tw, "transmit outcome:\t%v\n", valueOrNone(run.TransmitOutcome))
+	tw.Flush()
+}
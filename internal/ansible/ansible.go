@@ -1,6 +1,7 @@
 package ansible
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,17 +10,64 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/redhatinsights/rhc-worker-playbook/internal/constants"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/redact"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/retention"
 	"github.com/rjeczalik/notify"
 )
 
+// RunOptions modify how ansible-playbook is invoked by ansible-runner.
+type RunOptions struct {
+	// CheckMode runs the playbook in check mode ("--check"). Modules report
+	// what they would change without making any changes, and every job event
+	// is marked as part of a dry run.
+	CheckMode bool
+
+	// Diff reports the changes made to files and templates ("--diff").
+	Diff bool
+
+	// ExtraVars are variables passed to the playbook ("-e"), through a file
+	// written for the run.
+	ExtraVars map[string]any
+}
+
+// cmdline returns the ansible-playbook arguments corresponding to the options.
+// If the options set extra vars, they are read from extraVarsPath. ansible-runner
+// splits the arguments joined by spaces as a shell would, so extraVarsPath is
+// quoted.
+func (o RunOptions) cmdline(extraVarsPath string) []string {
+	var args []string
+	if o.CheckMode {
+		args = append(args, "--check")
+	}
+	if o.Diff {
+		args = append(args, "--diff")
+	}
+	if len(o.ExtraVars) > 0 {
+		args = append(args, "-e", "@"+shellQuote(extraVarsPath))
+	}
+	return args
+}
+
+// shellQuote quotes s so that it is read back as a single word by a POSIX
+// shell, or by Python's shlex.split.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
 // Runner maintains the state of a playbook run during execution.
 type Runner struct {
 	// correlationId is the identity of the job. It is used in file paths and event
 	// metadata.
 	correlationId string
 
+	// options modify how ansible-playbook is invoked.
+	options RunOptions
+
 	// events contain runner events, marshaled as raw JSON. Receive values from
 	// this channel to receive the current state of the run.
 	events chan json.RawMessage
@@ -28,42 +76,158 @@ type Runner struct {
 	// not completed.
 	Status string
 
+	// Result summarizes the run. It will be nil if the job has not completed.
+	Result *Result
+
 	playbookPath   string
+	extraVarsPath  string
 	jobEventsPath  string
 	statusFilePath string
+	rcFilePath     string
 
 	stopJobEventsWatch chan struct{}
+
+	// redactor masks sensitive data in job events before they are sent to
+	// the events channel.
+	redactor *redact.Redactor
+
+	// selection selects the job events that are sent to the events channel.
+	selection EventSelection
+
+	// messageVersion is the version of the message schema job events are
+	// narrowed to.
+	messageVersion int
+
+	// progressLock guards pid, started and task, which are read by other
+	// goroutines while the run is in progress.
+	progressLock sync.Mutex
+	pid          int
+	started      time.Time
+	task         string
+}
+
+// Progress describes a run in progress.
+type Progress struct {
+	// PID is the process ID of ansible-runner.
+	PID int
+
+	// Task is the name of the task being run. It is empty until the first
+	// task starts.
+	Task string
+
+	// Elapsed is the time since ansible-runner started.
+	Elapsed time.Duration
 }
 
 // NewRunner creates a new Runner, uniquely identified by ID.
-func NewRunner(correlationId string, events chan json.RawMessage) *Runner {
+func NewRunner(correlationId string, options RunOptions, events chan json.RawMessage) *Runner {
 	return &Runner{
 		events:        events,
 		correlationId: correlationId,
+		options:       options,
 		playbookPath:  filepath.Join(constants.StateDir, correlationId+".yaml"),
+		extraVarsPath: filepath.Join(constants.StateDir, correlationId+".extravars.json"),
 		jobEventsPath: filepath.Join(
 			constants.PrivateDataDir, "artifacts", correlationId, "job_events",
 		),
 		statusFilePath: filepath.Join(
 			constants.PrivateDataDir, "artifacts", correlationId, "status",
 		),
+		rcFilePath: filepath.Join(
+			constants.PrivateDataDir, "artifacts", correlationId, "rc",
+		),
 		stopJobEventsWatch: make(chan struct{}),
+		messageVersion:     MessageVersion1,
+	}
+}
+
+// SetRedactor masks sensitive data in every job event subsequently sent by the
+// Runner, using r.
+func (r *Runner) SetRedactor(redactor *redact.Redactor) {
+	r.redactor = redactor
+}
+
+// SetEventSelection limits the job events subsequently sent by the Runner to
+// those selected by selection.
+func (r *Runner) SetEventSelection(selection EventSelection) {
+	r.selection = selection
+}
+
+// SetMessageVersion narrows every job event subsequently sent by the Runner
+// to version of the message schema.
+func (r *Runner) SetMessageVersion(version int) {
+	r.messageVersion = version
+}
+
+// Progress returns the progress of the run. It returns false if
+// ansible-runner is not running.
+func (r *Runner) Progress() (Progress, bool) {
+	r.progressLock.Lock()
+	defer r.progressLock.Unlock()
+
+	if r.pid == 0 {
+		return Progress{}, false
 	}
+	return Progress{
+		PID:     r.pid,
+		Task:    r.task,
+		Elapsed: time.Since(r.started),
+	}, true
 }
 
 // Run begins running the provided playbook, using the given ID as the run
 // identity. It returns after ansible-runner completes the playbook run.
 // Events will be sent to the runner's events channel. When the channel closes,
-// the run is complete.
-func (r *Runner) Run(playbook []byte) error {
+// the run is complete. If ctx is cancelled before ansible-runner exits, the
+// entire ansible-runner process group is killed and the cause of the
+// cancellation is wrapped in the returned error.
+func (r *Runner) Run(ctx context.Context, playbook []byte) error {
 	defer close(r.stopJobEventsWatch)
 
+	if ctx.Err() != nil {
+		return fmt.Errorf("cannot run playbook: err=%w", context.Cause(ctx))
+	}
+
+	// Mark the run as in progress, so that the retention policy applied by
+	// any worker process leaves its files alone.
+	unlock, err := retention.Lock(constants.StateDir, r.correlationId)
+	if err != nil {
+		return fmt.Errorf("cannot lock run: err=%w", err)
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			slog.Error("cannot unlock run:", "err", err)
+		}
+	}()
+
 	// write playbook to the filesystem
 	slog.Info("writing playbook to file:", "path", r.playbookPath)
 	if err := os.WriteFile(r.playbookPath, playbook, 0600); err != nil {
 		return fmt.Errorf("cannot write playbook file: path=%v err=%w", r.playbookPath, err)
 	}
 
+	// ansible-runner passes the env/extravars file of the private data
+	// directory, which is shared by every run, to every playbook. Remove any
+	// such file, left by an earlier version of the worker or by hand, so that
+	// it cannot leak into this run.
+	sharedExtraVarsPath := filepath.Join(constants.PrivateDataDir, "env", "extravars")
+	if err := os.Remove(sharedExtraVarsPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove extra vars file: path=%v err=%w", sharedExtraVarsPath, err)
+	}
+
+	// write extra vars to a file of the run's own, passed to ansible-playbook
+	// on its command line, and remove it as soon as the run completes.
+	if len(r.options.ExtraVars) > 0 {
+		if err := r.writeExtraVars(); err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.Remove(r.extraVarsPath); err != nil {
+				slog.Error("cannot remove extra vars file:", "path", r.extraVarsPath, "err", err)
+			}
+		}()
+	}
+
 	// precreate the job_events directory so that we can watch for when events
 	// get written to it.
 	slog.Info("creating job_events directory:", "path", r.jobEventsPath)
@@ -80,17 +244,7 @@ func (r *Runner) Run(playbook []byte) error {
 	// marshaled into JSON and sent to the events channel.
 	go r.watchJobEvents()
 
-	ansibleRunnerCmd := exec.Command(
-		"/usr/bin/python3",
-		"-m",
-		"ansible_runner",
-		"run",
-		"--ident",
-		r.correlationId,
-		"--playbook",
-		r.playbookPath,
-		constants.PrivateDataDir,
-	)
+	ansibleRunnerCmd := exec.CommandContext(ctx, constants.Python3Path, r.args()...)
 	ansibleRunnerCmd.Env = []string{
 		"PATH=/sbin:/bin:/usr/sbin:/usr/bin",
 		"PYTHONPATH=" + filepath.Join(constants.LibDir, "rhc-worker-playbook"),
@@ -105,20 +259,49 @@ func (r *Runner) Run(playbook []byte) error {
 			"ansible_collections",
 		),
 	}
+	// ansible-runner forks ansible-playbook, which in turn forks its own
+	// workers. Place them all in a new process group so that the entire tree
+	// can be terminated if the run is cancelled.
+	ansibleRunnerCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	ansibleRunnerCmd.Cancel = func() error {
+		slog.Info("terminating ansible-runner process group:", "pgid", ansibleRunnerCmd.Process.Pid)
+		return syscall.Kill(-ansibleRunnerCmd.Process.Pid, syscall.SIGKILL)
+	}
 
 	slog.Info("launching python3 (ansible-runner) subprocess")
 	slog.Debug("launching with parameters:",
 		"args", ansibleRunnerCmd.Args,
 		"env", ansibleRunnerCmd.Env,
 	)
+	started := time.Now()
 	if err := ansibleRunnerCmd.Start(); err != nil {
 		return fmt.Errorf("cannot start ansible-runner: err=%w", err)
 	}
 
 	slog.Info("run started:", "pid", ansibleRunnerCmd.Process.Pid)
 
-	if err := ansibleRunnerCmd.Wait(); err != nil {
-		return fmt.Errorf("error executing ansible-runner: err=%w", err)
+	r.progressLock.Lock()
+	r.pid = ansibleRunnerCmd.Process.Pid
+	r.started = started
+	r.progressLock.Unlock()
+
+	err = ansibleRunnerCmd.Wait()
+
+	r.progressLock.Lock()
+	r.pid = 0
+	r.progressLock.Unlock()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("ansible-runner terminated: err=%w", context.Cause(ctx))
+		}
+		// ansible-runner exits with the return code of ansible-playbook, so a
+		// failed playbook is a completed run whose status is read below.
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return fmt.Errorf("error executing ansible-runner: err=%w", err)
+		}
+		slog.Info("ansible-runner exited:", "pid", ansibleRunnerCmd.Process.Pid, "code", exitErr.ExitCode())
 	}
 
 	defer func() {
@@ -128,8 +311,74 @@ func (r *Runner) Run(playbook []byte) error {
 		)
 	}()
 
-	if err := r.processStatus(); err != nil {
-		return err
+	statusErr := r.processStatus()
+	if r.Status == "" {
+		// ansible-runner exited without recording a status, so it did not
+		// complete the run.
+		if err != nil {
+			return fmt.Errorf("error executing ansible-runner: err=%w", errors.Join(err, statusErr))
+		}
+		return statusErr
+	}
+	r.Result = r.summarize(time.Since(started))
+
+	return statusErr
+}
+
+// args returns the python3 arguments that run the playbook with
+// ansible-runner.
+func (r *Runner) args() []string {
+	args := []string{
+		"-m",
+		"ansible_runner",
+		"run",
+		"--ident",
+		r.correlationId,
+		"--playbook",
+		r.playbookPath,
+	}
+	// ansible-runner parses its options with argparse, which would read a
+	// separate value starting with "--", such as "--check", as an option of
+	// its own.
+	if cmdline := r.options.cmdline(r.extraVarsPath); len(cmdline) > 0 {
+		args = append(args, "--cmdline="+strings.Join(cmdline, " "))
+	}
+	return append(args, constants.PrivateDataDir)
+}
+
+// summarize builds the Result of a completed run from the artifacts written
+// by ansible-runner. Missing artifacts are logged and left out of the Result.
+func (r *Runner) summarize(duration time.Duration) *Result {
+	result := &Result{
+		Status:   r.Status,
+		Duration: duration,
+	}
+
+	rc, err := readRC(r.rcFilePath)
+	if err != nil {
+		slog.Warn("cannot read return code:", "err", err)
+	}
+	result.RC = rc
+
+	hosts, err := readHostTotals(r.jobEventsPath)
+	if err != nil {
+		slog.Warn("cannot read host totals:", "err", err)
+	}
+	result.Hosts = hosts
+
+	return result
+}
+
+// writeExtraVars writes the run's extra vars to the run's extra vars file.
+func (r *Runner) writeExtraVars() error {
+	data, err := json.Marshal(r.options.ExtraVars)
+	if err != nil {
+		return fmt.Errorf("cannot marshal extra vars: err=%w", err)
+	}
+
+	slog.Info("writing extra vars to file:", "path", r.extraVarsPath)
+	if err := os.WriteFile(r.extraVarsPath, data, 0600); err != nil {
+		return fmt.Errorf("cannot write extra vars file: path=%v err=%w", r.extraVarsPath, err)
 	}
 
 	return nil
@@ -159,6 +408,28 @@ func (r *Runner) handleJobEvent(event notify.EventInfo) {
 			return
 		}
 
+		eventType, _ := ansibleEvent["event"].(string)
+		if eventType == "playbook_on_task_start" || eventType == "playbook_on_handler_task_start" {
+			if eventData, ok := ansibleEvent["event_data"].(map[string]any); ok {
+				task, _ := eventData["task"].(string)
+				r.progressLock.Lock()
+				r.task = task
+				r.progressLock.Unlock()
+			}
+		}
+
+		if !r.selection.selects(eventType) {
+			slog.Debug("skipping unselected job event:", "path", eventPath, "event", eventType)
+			return
+		}
+
+		// Mask sensitive data before anything else reads the event, so that
+		// it is masked even if the event is sent unfiltered.
+		redactions := 0
+		if r.redactor != nil {
+			redactions = r.redactor.Event(ansibleEvent)
+		}
+
 		eventData, ok := ansibleEvent["event_data"]
 		if !ok {
 			eventData = map[string]any{}
@@ -166,7 +437,13 @@ func (r *Runner) handleJobEvent(event notify.EventInfo) {
 		if _, has := eventData.(map[string]any)["crc_dispatcher_correlation_id"]; !has {
 			eventData.(map[string]any)["crc_dispatcher_correlation_id"] = r.correlationId
 		}
-		eventData.(map[string]any)["crc_message_version"] = 1
+		eventData.(map[string]any)["crc_message_version"] = r.messageVersion
+		if r.options.CheckMode {
+			eventData.(map[string]any)["crc_dispatcher_check_mode"] = true
+		}
+		if redactions > 0 {
+			eventData.(map[string]any)["crc_dispatcher_redactions"] = redactions
+		}
 		ansibleEvent["event_data"] = eventData
 
 		// "counter" is a required field according to playbook-dispatcher's
@@ -190,7 +467,7 @@ func (r *Runner) handleJobEvent(event notify.EventInfo) {
 			return
 		}
 
-		filteredModifiedData, err := filterJobEvent(modifiedData)
+		filteredModifiedData, err := filterJobEvent(modifiedData, r.messageVersion)
 
 		if err != nil {
 			// problem filtering, return original event
@@ -250,11 +527,19 @@ func (r *Runner) watchJobEvents() {
 }
 
 // filterJobEvent filters the Ansible job event based on
-// a built-in schema of known necessary data
-func filterJobEvent(jobEventData []byte) ([]byte, error) {
+// a built-in schema of known necessary data, in the given version
+func filterJobEvent(jobEventData []byte, version int) ([]byte, error) {
 	// filter the event by narrowing to the playbook-dispatcher types
-	var filteredEvent PlaybookRunResponseMessageEventsElem
-	if err := json.Unmarshal(jobEventData, &filteredEvent); err != nil {
+	var filteredEvent any
+	switch version {
+	case MessageVersion1:
+		filteredEvent = &PlaybookRunResponseMessageEventsElem{}
+	case MessageVersion2:
+		filteredEvent = &PlaybookRunResponseMessageEventsElemV2{}
+	default:
+		return nil, fmt.Errorf("unsupported message version: %v", version)
+	}
+	if err := json.Unmarshal(jobEventData, filteredEvent); err != nil {
 		return nil, err
 	}
 
@@ -1,11 +1,26 @@
 package ansible
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/constants"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/outbox"
 )
 
 // seed uuid.New function for deterministic tests
@@ -43,7 +58,7 @@ func TestFilterJobEvent(t *testing.T) {
        "uuid": "080027c2-7382-b2cc-1967-000000000001"
 	}`)
 
-	filteredJobEventData, err := filterJobEvent(sampleJobEventData)
+	filteredJobEventData, err := filterJobEvent(sampleJobEventData, MessageVersion1)
 
 	// should be filtered (different) since attributes were reduced
 	if reflect.DeepEqual(filteredJobEventData, sampleJobEventData) {
@@ -90,7 +105,7 @@ func TestFilterJobEventFails(t *testing.T) {
        "uuid": "080027c2-7382-b2cc-1967-000000000001"
 	}`)
 
-	filteredJobEventData, err := filterJobEvent(sampleJobEventData)
+	filteredJobEventData, err := filterJobEvent(sampleJobEventData, MessageVersion1)
 
 	// should be nil
 	if filteredJobEventData != nil {
@@ -152,6 +167,7 @@ func TestGenerateExecutorOnStartEvent(t *testing.T) {
 	}
 	receivedStartEvent := generateExecutorOnStartEvent(
 		"dcdc7b28-6800-4af9-983a-60fda58a7156",
+		nil,
 		mockUuid,
 	)
 
@@ -163,3 +179,1161 @@ func TestGenerateExecutorOnStartEvent(t *testing.T) {
 		)
 	}
 }
+
+func TestGenerateExecutorOnStartEventSigningKeys(t *testing.T) {
+
+	expectedStartEvent := map[string]any{
+		"event":      "executor_on_start",
+		"uuid":       seededUuidString,
+		"counter":    -1,
+		"stdout":     "",
+		"start_line": 0,
+		"end_line":   0,
+		"event_data": map[string]any{
+			"crc_dispatcher_correlation_id":          "dcdc7b28-6800-4af9-983a-60fda58a7156",
+			"crc_dispatcher_signing_key_fingerprint": "6B0D1E3E3F1F0E4C8D5A0F3C1C5B7E2A9D8C7B6A,0F1E2D3C4B5A69788796A5B4C3D2E1F00F1E2D3C",
+		},
+	}
+	receivedStartEvent := generateExecutorOnStartEvent(
+		"dcdc7b28-6800-4af9-983a-60fda58a7156",
+		[]string{
+			"6B0D1E3E3F1F0E4C8D5A0F3C1C5B7E2A9D8C7B6A",
+			"0F1E2D3C4B5A69788796A5B4C3D2E1F00F1E2D3C",
+		},
+		mockUuid,
+	)
+
+	if !reflect.DeepEqual(expectedStartEvent, receivedStartEvent) {
+		t.Errorf(
+			"EXPECTED: %v\nRECEIVED: %v",
+			expectedStartEvent,
+			receivedStartEvent,
+		)
+	}
+}
+
+func TestGenerateExecutorOnQueuedEvent(t *testing.T) {
+
+	expectedQueuedEvent := map[string]any{
+		"event":      "executor_on_queued",
+		"uuid":       seededUuidString,
+		"counter":    -1,
+		"stdout":     "",
+		"start_line": 0,
+		"end_line":   0,
+		"event_data": map[string]any{
+			"crc_dispatcher_correlation_id": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+			"crc_dispatcher_queue_position": 2,
+		},
+	}
+	receivedQueuedEvent := generateExecutorOnQueuedEvent(
+		"dcdc7b28-6800-4af9-983a-60fda58a7156",
+		2,
+		mockUuid,
+	)
+
+	if !reflect.DeepEqual(expectedQueuedEvent, receivedQueuedEvent) {
+		t.Errorf(
+			"EXPECTED: %v\nRECEIVED: %v",
+			expectedQueuedEvent,
+			receivedQueuedEvent,
+		)
+	}
+}
+
+func TestRunOptionsCmdline(t *testing.T) {
+	tests := []struct {
+		description string
+		input       RunOptions
+		path        string
+		want        []string
+	}{
+		{
+			description: "no options",
+			input:       RunOptions{},
+			want:        nil,
+		},
+		{
+			description: "check mode",
+			input:       RunOptions{CheckMode: true},
+			want:        []string{"--check"},
+		},
+		{
+			description: "check mode and diff",
+			input:       RunOptions{CheckMode: true, Diff: true},
+			want:        []string{"--check", "--diff"},
+		},
+		{
+			description: "extra vars",
+			input:       RunOptions{ExtraVars: map[string]any{"name": "value"}},
+			want:        []string{"-e", "@'/run/extravars.json'"},
+		},
+		{
+			description: "extra vars path with spaces and quotes",
+			input:       RunOptions{ExtraVars: map[string]any{"name": "value"}},
+			path:        "/run/x -e ansible_become=true '.json",
+			want:        []string{"-e", `@'/run/x -e ansible_become=true '"'"'.json'`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			path := test.path
+			if path == "" {
+				path = "/run/extravars.json"
+			}
+			got := test.input.cmdline(path)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.want, got)
+			}
+		})
+	}
+}
+
+// test that the check mode marker survives job event filtering
+func TestRunnerArgs(t *testing.T) {
+	tests := []struct {
+		description string
+		input       RunOptions
+		want        []string
+	}{
+		{
+			description: "no options",
+			input:       RunOptions{},
+			want:        nil,
+		},
+		{
+			description: "check mode",
+			input:       RunOptions{CheckMode: true},
+			want:        []string{"--cmdline=--check"},
+		},
+		{
+			description: "diff",
+			input:       RunOptions{Diff: true},
+			want:        []string{"--cmdline=--diff"},
+		},
+		{
+			description: "check mode and diff",
+			input:       RunOptions{CheckMode: true, Diff: true},
+			want:        []string{"--cmdline=--check --diff"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			runner := NewRunner("id", test.input, nil)
+			got := runner.args()
+
+			want := []string{"-m", "ansible_runner", "run", "--ident", "id", "--playbook", runner.playbookPath}
+			want = append(want, test.want...)
+			want = append(want, constants.PrivateDataDir)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", want, got)
+			}
+		})
+	}
+}
+
+func TestFilterJobEventCheckMode(t *testing.T) {
+	sampleJobEventData := []byte(`{
+       "counter": 4,
+       "end_line": 4,
+       "event": "playbook_on_play_start",
+       "event_data": {
+           "crc_dispatcher_correlation_id": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+           "crc_dispatcher_check_mode": true,
+           "crc_message_version": 1
+       },
+       "start_line": 2,
+       "uuid": "080027c2-7382-b2cc-1967-000000000001"
+	}`)
+
+	filteredJobEventData, err := filterJobEvent(sampleJobEventData, MessageVersion1)
+	if err != nil {
+		t.Fatalf("Received unexpected error value: %v", err)
+	}
+
+	var filteredEvent PlaybookRunResponseMessageEventsElem
+	if err := json.Unmarshal(filteredJobEventData, &filteredEvent); err != nil {
+		t.Fatal(err)
+	}
+	if filteredEvent.EventData.CrcDispatcherCheckMode == nil ||
+		!*filteredEvent.EventData.CrcDispatcherCheckMode {
+		t.Errorf("check mode marker missing from filtered event: %v", string(filteredJobEventData))
+	}
+}
+
+func TestBatchPolicyReady(t *testing.T) {
+	oldest := time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		policy      BatchPolicy
+		count       int
+		size        int
+		now         time.Time
+		want        bool
+	}{
+		{
+			description: "no events",
+			policy:      BatchPolicy{MaxEvents: 1},
+			now:         oldest,
+			want:        false,
+		},
+		{
+			description: "below every limit",
+			policy:      BatchPolicy{MaxEvents: 10, MaxBytes: 1024, MaxLatency: time.Minute},
+			count:       9,
+			size:        1023,
+			now:         oldest.Add(59 * time.Second),
+			want:        false,
+		},
+		{
+			description: "event limit",
+			policy:      BatchPolicy{MaxEvents: 10, MaxBytes: 1024, MaxLatency: time.Minute},
+			count:       10,
+			size:        100,
+			now:         oldest,
+			want:        true,
+		},
+		{
+			description: "byte limit",
+			policy:      BatchPolicy{MaxEvents: 10, MaxBytes: 1024, MaxLatency: time.Minute},
+			count:       2,
+			size:        1024,
+			now:         oldest,
+			want:        true,
+		},
+		{
+			description: "latency limit",
+			policy:      BatchPolicy{MaxEvents: 10, MaxBytes: 1024, MaxLatency: time.Minute},
+			count:       1,
+			size:        100,
+			now:         oldest.Add(time.Minute),
+			want:        true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := test.policy.ready(test.count, test.size, oldest, test.now)
+			if got != test.want {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestBatchPolicySplit(t *testing.T) {
+	events := []json.RawMessage{
+		json.RawMessage(`{"counter":1}`),
+		json.RawMessage(`{"counter":2}`),
+		json.RawMessage(`{"counter":3,"stdout":"0123456789"}`),
+		json.RawMessage(`{"counter":4}`),
+		json.RawMessage(`{"counter":5}`),
+	}
+
+	// sizes returns the number of events in each batch.
+	sizes := func(batches [][]json.RawMessage) []int {
+		var sizes []int
+		for _, batch := range batches {
+			sizes = append(sizes, len(batch))
+		}
+		return sizes
+	}
+
+	tests := []struct {
+		description string
+		policy      BatchPolicy
+		want        []int
+	}{
+		{
+			description: "no limits",
+			policy:      BatchPolicy{},
+			want:        []int{5},
+		},
+		{
+			description: "event limit",
+			policy:      BatchPolicy{MaxEvents: 2},
+			want:        []int{2, 2, 1},
+		},
+		{
+			description: "byte limit",
+			policy:      BatchPolicy{MaxBytes: 30},
+			want:        []int{2, 1, 2},
+		},
+		{
+			description: "oversized event",
+			policy:      BatchPolicy{MaxBytes: 20},
+			want:        []int{1, 1, 1, 1, 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := sizes(test.policy.split(events))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestBuildRequestBody(t *testing.T) {
+	body := `{"event":"executor_on_start"}` + "\n"
+
+	tests := []struct {
+		description  string
+		compress     bool
+		wantFilename string
+		wantEncoding string
+	}{
+		{
+			description:  "uncompressed",
+			compress:     false,
+			wantFilename: "runner-events",
+		},
+		{
+			description:  "compressed",
+			compress:     true,
+			wantFilename: "runner-events.gz",
+			wantEncoding: "gzip",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			requestBody, contentType, err := buildRequestBody(body, "runner-events", test.compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, params, err := mime.ParseMediaType(contentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part, err := multipart.NewReader(requestBody, params["boundary"]).NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := part.FileName(); got != test.wantFilename {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.wantFilename, got)
+			}
+			if got := part.Header.Get("Content-Type"); got != "application/vnd.redhat.playbook.v1+jsonl" {
+				t.Errorf("unexpected content type: %v", got)
+			}
+			if got := part.Header.Get("Content-Encoding"); got != test.wantEncoding {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.wantEncoding, got)
+			}
+
+			var reader io.Reader = part
+			if test.compress {
+				reader, err = gzip.NewReader(part)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != body {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", body, string(got))
+			}
+		})
+	}
+}
+
+func TestEventSelectionSelects(t *testing.T) {
+	tests := []struct {
+		description string
+		selection   EventSelection
+		input       string
+		want        bool
+	}{
+		{
+			description: "default",
+			selection:   EventSelection{},
+			input:       "runner_on_start",
+			want:        true,
+		},
+		{
+			description: "summary skips task start",
+			selection:   EventSelection{Preset: EventPresetSummary},
+			input:       "playbook_on_task_start",
+			want:        false,
+		},
+		{
+			description: "summary keeps results",
+			selection:   EventSelection{Preset: EventPresetSummary},
+			input:       "runner_on_ok",
+			want:        true,
+		},
+		{
+			description: "failures-only skips results",
+			selection:   EventSelection{Preset: EventPresetFailuresOnly},
+			input:       "runner_on_ok",
+			want:        false,
+		},
+		{
+			description: "failures-only keeps stats",
+			selection:   EventSelection{Preset: EventPresetFailuresOnly},
+			input:       "playbook_on_stats",
+			want:        true,
+		},
+		{
+			description: "include",
+			selection: EventSelection{
+				Preset:  EventPresetFailuresOnly,
+				Include: []string{"playbook_on_start"},
+			},
+			input: "playbook_on_start",
+			want:  true,
+		},
+		{
+			description: "exclude",
+			selection: EventSelection{
+				Preset:  EventPresetFull,
+				Include: []string{"runner_on_start"},
+				Exclude: []string{"runner_on_start"},
+			},
+			input: "runner_on_start",
+			want:  false,
+		},
+		{
+			description: "executor events",
+			selection: EventSelection{
+				Preset:  EventPresetFailuresOnly,
+				Exclude: []string{"executor_on_start"},
+			},
+			input: "executor_on_start",
+			want:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := test.selection.selects(test.input)
+			if got != test.want {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.want, got)
+			}
+		})
+	}
+}
+
+// test that version 2 of the message schema keeps task and result details
+func TestFilterJobEventV2(t *testing.T) {
+	sampleJobEventData := []byte(`{
+       "counter": 9,
+       "created": "2025-08-19T17:54:41.500100+00:00",
+       "end_line": 12,
+       "event": "runner_on_ok",
+       "event_data": {
+           "crc_dispatcher_correlation_id": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+           "crc_message_version": 2,
+           "duration": 1.25,
+           "end": "2025-08-19T17:54:41.499000+00:00",
+           "event_loop": null,
+           "host": "localhost",
+           "play": "This is a sample playbook",
+           "play_uuid": "080027c2-7382-b2cc-1967-000000000001",
+           "playbook": "/var/lib/rhc-worker-playbook/dcdc7b28-6800-4af9-983a-60fda58a7156.yaml",
+           "playbook_uuid": "d0c79d62-4395-41f2-8bc4-8a73ad1df099",
+           "remote_addr": "localhost",
+           "res": {
+               "_ansible_no_log": false,
+               "changed": true,
+               "invocation": {"module_args": {"name": "httpd"}},
+               "msg": "Installed: httpd"
+           },
+           "resolved_action": "ansible.builtin.dnf",
+           "role": "webserver",
+           "start": "2025-08-19T17:54:40.249000+00:00",
+           "task": "install httpd",
+           "task_action": "dnf",
+           "task_args": "",
+           "task_path": "/var/lib/rhc-worker-playbook/dcdc7b28-6800-4af9-983a-60fda58a7156.yaml:6",
+           "task_uuid": "080027c2-7382-b2cc-1967-000000000003"
+       },
+       "parent_uuid": "080027c2-7382-b2cc-1967-000000000003",
+       "pid": 4652,
+       "runner_ident": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+       "start_line": 10,
+       "stdout": "changed: [localhost]",
+       "uuid": "080027c2-7382-b2cc-1967-000000000004"
+	}`)
+
+	filteredJobEventData, err := filterJobEvent(sampleJobEventData, MessageVersion2)
+	if err != nil {
+		t.Fatalf("Received unexpected error value: %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(filteredJobEventData, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"counter":      float64(9),
+		"created":      "2025-08-19T17:54:41.500100+00:00",
+		"end_line":     float64(12),
+		"event":        "runner_on_ok",
+		"parent_uuid":  "080027c2-7382-b2cc-1967-000000000003",
+		"runner_ident": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+		"start_line":   float64(10),
+		"stdout":       "changed: [localhost]",
+		"uuid":         "080027c2-7382-b2cc-1967-000000000004",
+		"event_data": map[string]any{
+			"crc_dispatcher_correlation_id": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+			"crc_message_version":           float64(2),
+			"duration":                      1.25,
+			"end":                           "2025-08-19T17:54:41.499000+00:00",
+			"host":                          "localhost",
+			"play":                          "This is a sample playbook",
+			"play_uuid":                     "080027c2-7382-b2cc-1967-000000000001",
+			"playbook":                      "/var/lib/rhc-worker-playbook/dcdc7b28-6800-4af9-983a-60fda58a7156.yaml",
+			"playbook_uuid":                 "d0c79d62-4395-41f2-8bc4-8a73ad1df099",
+			"res": map[string]any{
+				"changed": true,
+				"msg":     "Installed: httpd",
+			},
+			"resolved_action": "ansible.builtin.dnf",
+			"role":            "webserver",
+			"start":           "2025-08-19T17:54:40.249000+00:00",
+			"task":            "install httpd",
+			"task_action":     "dnf",
+			"task_uuid":       "080027c2-7382-b2cc-1967-000000000003",
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EXPECTED: %v\nRECEIVED: %v", want, got)
+	}
+}
+
+func TestFilterJobEventUnsupportedVersion(t *testing.T) {
+	if _, err := filterJobEvent([]byte(`{"event": "runner_on_ok"}`), 3); err == nil {
+		t.Error("expected an error for an unsupported message version")
+	}
+}
+
+func TestGenerateExecutorOnCompleteEvent(t *testing.T) {
+	tests := []struct {
+		description string
+		input       Result
+		want        map[string]any
+	}{
+		{
+			description: "successful run",
+			input: Result{
+				Status:   "successful",
+				RC:       0,
+				Duration: 1500 * time.Millisecond,
+				Hosts: map[string]HostTotals{
+					"localhost": {Ok: 3, Changed: 1},
+				},
+			},
+			want: map[string]any{
+				"event":      "executor_on_complete",
+				"uuid":       seededUuidString,
+				"counter":    -1,
+				"stdout":     "",
+				"start_line": 0,
+				"end_line":   0,
+				"event_data": map[string]any{
+					"crc_dispatcher_correlation_id": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+					"crc_dispatcher_status":         "successful",
+					"crc_dispatcher_rc":             0,
+					"crc_dispatcher_duration":       1.5,
+					"crc_dispatcher_hosts": map[string]HostTotals{
+						"localhost": {Ok: 3, Changed: 1},
+					},
+				},
+			},
+		},
+		{
+			description: "failed run without stats",
+			input: Result{
+				Status:   "failed",
+				RC:       -1,
+				Duration: 2 * time.Second,
+			},
+			want: map[string]any{
+				"event":      "executor_on_complete",
+				"uuid":       seededUuidString,
+				"counter":    -1,
+				"stdout":     "",
+				"start_line": 0,
+				"end_line":   0,
+				"event_data": map[string]any{
+					"crc_dispatcher_correlation_id": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+					"crc_dispatcher_status":         "failed",
+					"crc_dispatcher_rc":             -1,
+					"crc_dispatcher_duration":       2.0,
+					"crc_dispatcher_hosts":          map[string]HostTotals{},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := generateExecutorOnCompleteEvent(
+				"dcdc7b28-6800-4af9-983a-60fda58a7156",
+				test.input,
+				mockUuid,
+			)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestReadHostTotals(t *testing.T) {
+	tests := []struct {
+		description string
+		files       map[string]string
+		want        map[string]HostTotals
+		wantError   bool
+	}{
+		{
+			description: "stats event",
+			files: map[string]string{
+				"1-a.json": `{"event":"playbook_on_start","event_data":{}}`,
+				"9-b.json": `{"event":"runner_on_ok","event_data":{"host":"localhost"}}`,
+				"10-c.json": `{"event":"playbook_on_stats","event_data":{` +
+					`"ok":{"localhost":3,"web":1},"changed":{"localhost":1},` +
+					`"failures":{"web":1},"skipped":{"localhost":2},"dark":{"db":1}}}`,
+			},
+			want: map[string]HostTotals{
+				"localhost": {Ok: 3, Changed: 1, Skipped: 2},
+				"web":       {Ok: 1, Failed: 1},
+				"db":        {Unreachable: 1},
+			},
+		},
+		{
+			description: "partial and unrelated files are ignored",
+			files: map[string]string{
+				"2-a.json":         `{"event":"playbook_on_stats","event_data":{"ok":{"localhost":1}}}`,
+				"3-b-partial.json": `{"event":"playbook_on_stats","event_data":{"ok":{"localhost":9}}}`,
+				"stdout.txt":       "",
+			},
+			want: map[string]HostTotals{
+				"localhost": {Ok: 1},
+			},
+		},
+		{
+			description: "missing stats event",
+			files: map[string]string{
+				"1-a.json": `{"event":"playbook_on_start","event_data":{}}`,
+			},
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := readHostTotals(dir)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestReadRC(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rc")
+	if err := os.WriteFile(path, []byte("2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readRC(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("got %v, want %v", got, 2)
+	}
+
+	got, err = readRC(filepath.Join(dir, "missing"))
+	if err == nil || got != -1 {
+		t.Errorf("got %v, %v; want -1 and an error", got, err)
+	}
+}
+
+// fakeAnsibleRunner replaces the python3 interpreter running ansible-runner
+// with a script that records status and rc in the artifacts of the run, then
+// exits with rc.
+func fakeAnsibleRunner(t *testing.T, status string, rc int) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "python3")
+	data := fmt.Sprintf(`#!/bin/sh
+ident=$5
+for dir; do :; done
+mkdir -p "$dir/artifacts/$ident"
+printf %%s %v > "$dir/artifacts/$ident/status"
+printf %%s %v > "$dir/artifacts/$ident/rc"
+exit %v
+`, status, rc, rc)
+	if err := os.WriteFile(script, []byte(data), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	python3Path, stateDir, privateDataDir := constants.Python3Path, constants.StateDir, constants.PrivateDataDir
+	t.Cleanup(func() {
+		constants.Python3Path, constants.StateDir, constants.PrivateDataDir = python3Path, stateDir, privateDataDir
+	})
+	constants.Python3Path = script
+	constants.StateDir = dir
+	constants.PrivateDataDir = filepath.Join(dir, "runs")
+}
+
+func TestRunFailedPlaybook(t *testing.T) {
+	fakeAnsibleRunner(t, "failed", 2)
+
+	runner := NewRunner("failed-run", RunOptions{}, make(chan json.RawMessage))
+	err := runner.Run(context.Background(), []byte("- hosts: localhost\n"))
+	if err == nil {
+		t.Error("expected error")
+	}
+	if runner.Status != "failed" {
+		t.Errorf("got status %q, want %q", runner.Status, "failed")
+	}
+	if runner.Result == nil {
+		t.Fatal("a failed playbook should be summarized")
+	}
+	if runner.Result.Status != "failed" || runner.Result.RC != 2 {
+		t.Errorf("got status %q rc %v, want status %q rc %v", runner.Result.Status, runner.Result.RC, "failed", 2)
+	}
+}
+
+func TestGenerateExecutorOnHeartbeatEvent(t *testing.T) {
+	tests := []struct {
+		description string
+		input       Progress
+		want        map[string]any
+	}{
+		{
+			description: "running task",
+			input:       Progress{PID: 4242, Task: "Update packages", Elapsed: 90 * time.Second},
+			want: map[string]any{
+				"event":      "executor_on_heartbeat",
+				"uuid":       seededUuidString,
+				"counter":    -1,
+				"stdout":     "",
+				"start_line": 0,
+				"end_line":   0,
+				"event_data": map[string]any{
+					"crc_dispatcher_correlation_id": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+					"crc_dispatcher_elapsed":        90.0,
+					"crc_dispatcher_pid":            4242,
+					"crc_dispatcher_task":           "Update packages",
+				},
+			},
+		},
+		{
+			description: "before the first task",
+			input:       Progress{PID: 4242, Elapsed: 500 * time.Millisecond},
+			want: map[string]any{
+				"event":      "executor_on_heartbeat",
+				"uuid":       seededUuidString,
+				"counter":    -1,
+				"stdout":     "",
+				"start_line": 0,
+				"end_line":   0,
+				"event_data": map[string]any{
+					"crc_dispatcher_correlation_id": "dcdc7b28-6800-4af9-983a-60fda58a7156",
+					"crc_dispatcher_elapsed":        0.5,
+					"crc_dispatcher_pid":            4242,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := generateExecutorOnHeartbeatEvent(
+				"dcdc7b28-6800-4af9-983a-60fda58a7156",
+				test.input,
+				mockUuid,
+			)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestSendHeartbeats(t *testing.T) {
+	events := make(chan json.RawMessage)
+	e := NewEventManager("", "dcdc7b28-6800-4af9-983a-60fda58a7156", "", time.Second, nil, events, nil)
+	e.SetHeartbeatInterval(time.Millisecond)
+
+	running := make(chan bool, 1)
+	running <- false
+	progress := func() (Progress, bool) {
+		select {
+		case r := <-running:
+			return Progress{PID: 4242, Task: "Update packages"}, r
+		default:
+			return Progress{PID: 4242, Task: "Update packages"}, true
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go e.SendHeartbeats(progress, stop, done)
+
+	var event struct {
+		Event     string         `json:"event"`
+		EventData map[string]any `json:"event_data"`
+	}
+	if err := json.Unmarshal(<-events, &event); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	// drain a heartbeat sent before stop was noticed
+	select {
+	case <-events:
+	case <-done:
+	}
+	<-done
+
+	if event.Event != "executor_on_heartbeat" {
+		t.Errorf("got %v, want %v", event.Event, "executor_on_heartbeat")
+	}
+	if event.EventData["crc_dispatcher_task"] != "Update packages" {
+		t.Errorf("got %v, want %v", event.EventData["crc_dispatcher_task"], "Update packages")
+	}
+}
+
+func TestSendHeartbeatsDisabled(t *testing.T) {
+	e := NewEventManager("", "", "", time.Second, nil, nil, nil)
+	done := make(chan struct{})
+	go e.SendHeartbeats(func() (Progress, bool) { return Progress{}, true }, make(chan struct{}), done)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("SendHeartbeats did not return with a zero heartbeat interval")
+	}
+}
+
+// fakeTransmitter is a transmit.Transmitter responding to each transmission
+// with the next of its response codes, recording the events transmitted.
+type fakeTransmitter struct {
+	codes         []int
+	transmissions [][]string
+
+	// responseMetadata is returned with every response.
+	responseMetadata map[string]string
+}
+
+func (f *fakeTransmitter) Transmit(
+	addr string,
+	id string,
+	responseTo string,
+	metadata map[string]string,
+	data []byte,
+) (int, map[string]string, []byte, error) {
+	_, params, err := mime.ParseMediaType(metadata["Content-Type"])
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	part, err := multipart.NewReader(bytes.NewReader(data), params["boundary"]).NextPart()
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	content, err := io.ReadAll(part)
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	f.transmissions = append(f.transmissions, strings.Fields(string(content)))
+
+	code := http.StatusAccepted
+	if len(f.codes) > 0 {
+		code, f.codes = f.codes[0], f.codes[1:]
+	}
+	if f.responseMetadata != nil {
+		return code, f.responseMetadata, nil, nil
+	}
+	return code, map[string]string{}, nil, nil
+}
+
+func TestTransmitUnacknowledged(t *testing.T) {
+	events := []json.RawMessage{
+		json.RawMessage(`{"counter":1}`),
+		json.RawMessage(`{"counter":2}`),
+		json.RawMessage(`{"counter":3}`),
+	}
+
+	tests := []struct {
+		description       string
+		codes             []int
+		acknowledged      int
+		wantError         bool
+		wantTransmissions [][]string
+		wantAcknowledged  int
+	}{
+		{
+			description: "all batches accepted",
+			wantTransmissions: [][]string{
+				{`{"counter":1}`, `{"counter":2}`},
+				{`{"counter":3}`},
+			},
+			wantAcknowledged: 3,
+		},
+		{
+			description:  "only unacknowledged events",
+			acknowledged: 2,
+			wantTransmissions: [][]string{
+				{`{"counter":3}`},
+			},
+			wantAcknowledged: 3,
+		},
+		{
+			description: "second batch fails",
+			codes:       []int{http.StatusAccepted, http.StatusServiceUnavailable},
+			wantError:   true,
+			wantTransmissions: [][]string{
+				{`{"counter":1}`, `{"counter":2}`},
+				{`{"counter":3}`},
+			},
+			wantAcknowledged: 2,
+		},
+		{
+			description:  "conflict resends every event",
+			codes:        []int{http.StatusConflict},
+			acknowledged: 2,
+			wantError:    true,
+			wantTransmissions: [][]string{
+				{`{"counter":3}`},
+			},
+			wantAcknowledged: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			transmitter := &fakeTransmitter{codes: test.codes}
+			e := NewEventManager("", "", "", time.Second, transmitter, nil, nil)
+			e.SetBatchPolicy(BatchPolicy{MaxEvents: 2})
+			e.cachedEvents = events
+			e.receivedAt = make([]time.Time, len(events))
+			e.acknowledged = test.acknowledged
+
+			err := e.transmitUnacknowledged()
+			if test.wantError && err == nil {
+				t.Error("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(transmitter.transmissions, test.wantTransmissions) {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", test.wantTransmissions, transmitter.transmissions)
+			}
+			if e.acknowledged != test.wantAcknowledged {
+				t.Errorf("got %v, want %v", e.acknowledged, test.wantAcknowledged)
+			}
+		})
+	}
+}
+
+func TestTransmitUnacknowledgedResend(t *testing.T) {
+	o, err := outbox.Create(t.TempDir(), outbox.Metadata{MessageID: "message"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	transmitter := &fakeTransmitter{
+		codes: []int{http.StatusAccepted, http.StatusConflict, http.StatusAccepted},
+	}
+	e := NewEventManager("", "", "", time.Second, transmitter, nil, nil)
+	e.SetOutbox(o)
+	for _, event := range []string{`{"counter":1}`, `{"counter":2}`} {
+		e.cachedEvents = append(e.cachedEvents, json.RawMessage(event))
+		e.receivedAt = append(e.receivedAt, time.Time{})
+	}
+
+	// The first transmission is acknowledged, so it is recorded in the outbox
+	// and not sent again.
+	if err := e.transmitUnacknowledged(); err != nil {
+		t.Fatal(err)
+	}
+	if got := o.Acknowledged(); got != 2 {
+		t.Errorf("got %v acknowledged events, want 2", got)
+	}
+
+	// The server answers the next transmission with a conflict, so every
+	// event is sent again on the following transmission.
+	e.cachedEvents = append(e.cachedEvents, json.RawMessage(`{"counter":3}`))
+	e.receivedAt = append(e.receivedAt, time.Time{})
+	if err := e.transmitUnacknowledged(); err == nil {
+		t.Error("expected error")
+	}
+	if got := o.Acknowledged(); got != 0 {
+		t.Errorf("got %v acknowledged events, want 0", got)
+	}
+	if err := e.transmitUnacknowledged(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{`{"counter":1}`, `{"counter":2}`},
+		{`{"counter":3}`},
+		{`{"counter":1}`, `{"counter":2}`, `{"counter":3}`},
+	}
+	if !reflect.DeepEqual(transmitter.transmissions, want) {
+		t.Errorf("EXPECTED: %v\nRECEIVED: %v", want, transmitter.transmissions)
+	}
+	if got := o.Acknowledged(); got != 3 {
+		t.Errorf("got %v acknowledged events, want 3", got)
+	}
+}
+
+func TestAppendExecutorOnFailedEvent(t *testing.T) {
+	o, err := outbox.Create(t.TempDir(), outbox.Metadata{MessageID: "message", CorrelationID: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Append(json.RawMessage(`{"counter":1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AppendExecutorOnFailedEvent(o, "ERROR_KEY", errors.New("interrupted")); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := o.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %v events, want 2", len(events))
+	}
+	var got map[string]any
+	if err := json.Unmarshal(events[1], &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"crc_dispatcher_correlation_id": "1234",
+		"crc_dispatcher_error_code":     "ERROR_KEY",
+		"crc_dispatcher_error_details":  "interrupted",
+	}
+	if got["event"] != "executor_on_failed" || !reflect.DeepEqual(got["event_data"], want) {
+		t.Errorf("EXPECTED: %v\nRECEIVED: %v", want, got)
+	}
+}
+
+func TestDrainOutbox(t *testing.T) {
+	tests := []struct {
+		description string
+		codes       []int
+		wantError   bool
+	}{
+		{
+			description: "accepted",
+		},
+		{
+			description: "rejected",
+			codes:       []int{http.StatusBadRequest},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			root := t.TempDir()
+			o, err := outbox.Create(root, outbox.Metadata{MessageID: "message"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, event := range []string{`{"counter":1}`, `{"counter":2}`} {
+				if err := o.Append(json.RawMessage(event)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := o.Acknowledge(1); err != nil {
+				t.Fatal(err)
+			}
+
+			transmitter := &fakeTransmitter{codes: test.codes}
+			err = DrainOutbox(context.Background(), transmitter, o)
+			if test.wantError && err == nil {
+				t.Error("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			want := [][]string{{`{"counter":2}`}}
+			if !reflect.DeepEqual(transmitter.transmissions, want) {
+				t.Errorf("EXPECTED: %v\nRECEIVED: %v", want, transmitter.transmissions)
+			}
+			pending, err := outbox.Pending(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pending) != 0 {
+				t.Errorf("got %v pending outboxes, want 0", len(pending))
+			}
+		})
+	}
+}
+
+func TestDrainOutboxCancelled(t *testing.T) {
+	root := t.TempDir()
+	o, err := outbox.Create(root, outbox.Metadata{MessageID: "message"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Append(json.RawMessage(`{"counter":1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server asks for a retry in a day, which must neither be honored in
+	// full nor delay shutdown.
+	transmitter := &fakeTransmitter{
+		codes:            []int{http.StatusServiceUnavailable},
+		responseMetadata: map[string]string{"Retry-After": "86400"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err = DrainOutbox(ctx, transmitter, o)
+	if err == nil {
+		t.Error("expected error")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("drain took %v after cancellation", elapsed)
+	}
+
+	pending, err := outbox.Pending(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Errorf("got %v pending outboxes, want 1", len(pending))
+	}
+	for _, o := range pending {
+		_ = o.Close()
+	}
+}
@@ -0,0 +1,90 @@
+package ansible
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// maxUploadBytes is the largest runner-events payload transmitted in a single
+// request, matching the upload size limit of ingress. Larger batches are split
+// so that they are not rejected.
+const maxUploadBytes = 100 * 1024 * 1024
+
+// BatchPolicy decides when cached events are transmitted. Events are
+// transmitted as soon as any of the limits is reached. A zero limit is
+// ignored, and a zero BatchPolicy disables batching.
+type BatchPolicy struct {
+	// MaxEvents is the number of unsent events that triggers a transmission,
+	// and the largest number of events in a single batch.
+	MaxEvents int
+
+	// MaxBytes is the size of the JSONL encoded unsent events that triggers a
+	// transmission, and the largest size of a single batch.
+	MaxBytes int
+
+	// MaxLatency is the longest an event may wait before it is transmitted.
+	MaxLatency time.Duration
+}
+
+// Enabled reports whether the policy batches events.
+func (p BatchPolicy) Enabled() bool {
+	return p.MaxEvents > 0 || p.MaxBytes > 0 || p.MaxLatency > 0
+}
+
+// ready reports whether the unsent events, of which there are count taking
+// size bytes and the oldest of which was received at oldest, should be
+// transmitted at time now.
+func (p BatchPolicy) ready(count int, size int, oldest time.Time, now time.Time) bool {
+	switch {
+	case count == 0:
+		return false
+	case p.MaxEvents > 0 && count >= p.MaxEvents:
+		return true
+	case p.MaxBytes > 0 && size >= p.MaxBytes:
+		return true
+	case p.MaxLatency > 0 && now.Sub(oldest) >= p.MaxLatency:
+		return true
+	}
+	return false
+}
+
+// deadline returns the time at which events received at oldest must be
+// transmitted, or the zero time if the policy has no latency limit.
+func (p BatchPolicy) deadline(oldest time.Time) time.Time {
+	if p.MaxLatency <= 0 {
+		return time.Time{}
+	}
+	return oldest.Add(p.MaxLatency)
+}
+
+// split divides events into consecutive batches of at most p.MaxEvents events
+// and at most p.MaxBytes bytes of JSONL, never exceeding maxUploadBytes. An
+// event larger than the byte limit is transmitted in a batch of its own.
+func (p BatchPolicy) split(events []json.RawMessage) [][]json.RawMessage {
+	maxBytes := maxUploadBytes
+	if p.MaxBytes > 0 {
+		maxBytes = min(maxBytes, p.MaxBytes)
+	}
+
+	var batches [][]json.RawMessage
+	start, size := 0, 0
+	for i, event := range events {
+		eventSize := encodedSize(event)
+		full := (p.MaxEvents > 0 && i-start >= p.MaxEvents) || size+eventSize > maxBytes
+		if i > start && full {
+			batches = append(batches, events[start:i])
+			start, size = i, 0
+		}
+		size += eventSize
+	}
+	if start < len(events) {
+		batches = append(batches, events[start:])
+	}
+
+	return batches
+}
+
+// encodedSize returns the size of event once written as a line of JSONL.
+func encodedSize(event json.RawMessage) int {
+	return len(event) + 1
+}
@@ -2,21 +2,75 @@ package ansible
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime/multipart"
+	"net/http"
 	"net/textproto"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/redhatinsights/rhc-worker-playbook/internal/config"
-	"github.com/redhatinsights/yggdrasil/worker"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/outbox"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/transmit"
 )
 
+const (
+	// finalTransmitAttempts is the number of times the final batch of a run's
+	// events is sent before they are left in the outbox.
+	finalTransmitAttempts = 5
+
+	// drainTransmitAttempts is the number of times the events of an outbox
+	// left by a previous worker process are sent before giving up until the
+	// next restart.
+	drainTransmitAttempts = 10
+)
+
+// Outcomes of the final transmission of a run's events, reported by
+// TransmitOutcome.
+const (
+	// TransmitAcknowledged means the server acknowledged every event.
+	TransmitAcknowledged = "acknowledged"
+
+	// TransmitRejected means the server rejected the events, which were
+	// discarded.
+	TransmitRejected = "rejected"
+
+	// TransmitPending means the events could not be transmitted and were left
+	// in the outbox to be sent after the worker restarts.
+	TransmitPending = "pending"
+)
+
+// responseError is returned by transmitEvents when the server responds to a
+// transmission with an error status.
+type responseError struct {
+	code     int
+	metadata map[string]string
+	body     []byte
+}
+
+// rejected reports whether err is a response to which the server will respond
+// the same way however many times the events are sent.
+func rejected(err error) bool {
+	var respErr *responseError
+	return errors.As(err, &respErr) && !outbox.Retryable(respErr.code)
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf(
+		"server returned error response: code=%v responseMetadata=%v responseBody=%v",
+		e.code,
+		e.metadata,
+		string(e.body),
+	)
+}
+
 // createUuidFunc is a function that returns a UUID, typically uuid.New(),
 // used as a function parameter to decouple uuid generation from function logic
 type createUuidFunc func() uuid.UUID
@@ -26,11 +80,20 @@ type EventManager struct {
 	correlationId          string
 	returnURL              string
 	responseInterval       time.Duration
-	worker                 *worker.Worker
+	transmitter            transmit.Transmitter
 	cachedEvents           []json.RawMessage
+	receivedAt             []time.Time
+	acknowledged           int
 	cachedEventsLock       sync.RWMutex
+	eventCached            chan struct{}
 	stopTransmittingEvents chan struct{}
 	events                 chan json.RawMessage
+	checkMode              bool
+	outbox                 *outbox.Outbox
+	batchPolicy            BatchPolicy
+	compress               bool
+	heartbeatInterval      time.Duration
+	transmitOutcome        string
 }
 
 func NewEventManager(
@@ -38,7 +101,7 @@ func NewEventManager(
 	correlationId,
 	returnURL string,
 	responseInterval time.Duration,
-	worker *worker.Worker,
+	transmitter transmit.Transmitter,
 	events chan json.RawMessage,
 	stopTransmittingEvents chan struct{},
 ) *EventManager {
@@ -47,87 +110,384 @@ func NewEventManager(
 		correlationId:          correlationId,
 		returnURL:              returnURL,
 		responseInterval:       responseInterval,
-		worker:                 worker,
+		transmitter:            transmitter,
 		cachedEvents:           []json.RawMessage{},
+		eventCached:            make(chan struct{}, 1),
 		stopTransmittingEvents: stopTransmittingEvents,
 		events:                 events,
 	}
 }
 
+// SetCheckMode marks every executor event subsequently sent by the
+// EventManager as part of a run executed in check mode.
+func (e *EventManager) SetCheckMode(checkMode bool) {
+	e.checkMode = checkMode
+}
+
+// SetOutbox records every event subsequently received by the EventManager in
+// o, so that they survive a worker restart until the server acknowledges them.
+// The outbox is removed once the final transmission succeeds.
+func (e *EventManager) SetOutbox(o *outbox.Outbox) {
+	e.outbox = o
+}
+
+// SetBatchPolicy sets the policy deciding when cached events are transmitted.
+// If the policy is not enabled, every unacknowledged event is transmitted each
+// time the response interval elapses.
+func (e *EventManager) SetBatchPolicy(policy BatchPolicy) {
+	e.batchPolicy = policy
+}
+
+// SetCompression enables gzip compression of the events transmitted by the
+// EventManager.
+func (e *EventManager) SetCompression(compress bool) {
+	e.compress = compress
+}
+
+// SetHeartbeatInterval sets the time between the executor_on_heartbeat events
+// sent by SendHeartbeats. A zero interval disables heartbeats.
+func (e *EventManager) SetHeartbeatInterval(interval time.Duration) {
+	e.heartbeatInterval = interval
+}
+
 // processEvents receives values from the runner and caches them for future use.
 func (e *EventManager) ProcessEvents(done chan struct{}) {
 	defer close(done)
 	for event := range e.events {
 		e.cachedEventsLock.Lock()
 		e.cachedEvents = append(e.cachedEvents, event)
+		e.receivedAt = append(e.receivedAt, time.Now())
 		e.cachedEventsLock.Unlock()
+
+		if e.outbox != nil {
+			if err := e.outbox.Append(event); err != nil {
+				slog.Error("cannot record event:", "err", err)
+			}
+		}
+
+		// Wake TransmitCachedEvents, unless it has yet to handle a previous
+		// event.
+		select {
+		case e.eventCached <- struct{}{}:
+		default:
+		}
 	}
 }
 
-// transmitCachedEvents periodically transmits a batch of cached events when the
-// response interval timeout elapses.
-func (e *EventManager) TransmitCachedEvents(done chan struct{}) {
+// transmitCachedEvents transmits the cached events that the server has not
+// yet acknowledged. If batching events, they are transmitted as soon as the
+// batch policy allows. Otherwise, they are transmitted each time the response
+// interval timeout elapses. If ctx is cancelled while the final transmission
+// is retried, the remaining events are left in the outbox.
+func (e *EventManager) TransmitCachedEvents(ctx context.Context, done chan struct{}) {
 	defer close(done)
-	timeout := time.Tick(e.responseInterval)
-	batchStart := 0
+
+	timeout := time.NewTimer(e.responseInterval)
+	defer timeout.Stop()
+
+	// retryAt is the time before which no transmission is attempted, either
+	// because the server asked for it or to back off after a failure.
+	var retryAt time.Time
+	backoff := outbox.DefaultBackoff()
 	for {
 		select {
 		case <-e.stopTransmittingEvents:
-			// Transmit one final batch of all events.
-			e.cachedEventsLock.RLock()
-			if err := e.transmitEvents(e.cachedEvents); err != nil {
+			// Transmit the remaining unacknowledged events, retrying until the
+			// server acknowledges them. If it never does, the events are left
+			// in the outbox to be sent after the worker restarts, unless the
+			// server rejected them outright.
+			e.transmitOutcome = TransmitAcknowledged
+			if err := e.flush(ctx, finalTransmitAttempts); err != nil {
 				slog.Error("cannot transmit events:", "err", err)
+				if !rejected(err) {
+					e.transmitOutcome = TransmitPending
+					e.closeOutbox()
+					return
+				}
+				e.transmitOutcome = TransmitRejected
 			}
-			e.cachedEventsLock.RUnlock()
+			e.removeOutbox()
 			return
-		case <-timeout:
-			var batchEnd int
-
-			e.cachedEventsLock.RLock()
-			if config.DefaultConfig.BatchEvents > 0 {
-				// If batching events, compute the end of the batch, ensuring
-				// the end does not exceed the length of the cached events.
-				batchEnd = batchStart + config.DefaultConfig.BatchEvents
-				if batchEnd > len(e.cachedEvents) {
-					batchEnd = len(e.cachedEvents)
+		case <-e.eventCached:
+			if !e.batchPolicy.Enabled() {
+				continue
+			}
+		case <-timeout.C:
+		}
+
+		now := time.Now()
+		if now.Before(retryAt) {
+			timeout.Reset(retryAt.Sub(now))
+			continue
+		}
+
+		if !e.batchPolicy.Enabled() || e.batchReady(now) {
+			if err := e.transmitUnacknowledged(); err != nil {
+				slog.Error("cannot transmit events:", "err", err)
+				var retryAfter time.Duration
+				var respErr *responseError
+				if errors.As(err, &respErr) {
+					retryAfter = e.retryAfter(respErr, now)
 				}
+				retryAt = now.Add(backoff.Next(retryAfter))
 			} else {
-				// If not batching events, treat the entire slice as one
-				// "batch".
-				batchStart = 0
-				batchEnd = len(e.cachedEvents)
+				backoff.Reset()
 			}
+		}
 
-			// If the value of the current batch start has caught up to the
-			// known end of the cached events and the timeout has triggered
-			// again, skip this iteration.
-			if batchStart >= batchEnd {
-				e.cachedEventsLock.RUnlock()
-				continue
+		timeout.Reset(e.nextTransmission(now, retryAt))
+	}
+}
+
+// TransmitOutcome returns the outcome of the final transmission of the
+// events, once TransmitCachedEvents has returned.
+func (e *EventManager) TransmitOutcome() string {
+	return e.transmitOutcome
+}
+
+// SendHeartbeats sends an executor_on_heartbeat event each time the heartbeat
+// interval elapses while progress reports that the run is in progress, until
+// stop is closed. Heartbeats are cached and transmitted like any other event,
+// so that the server can tell a long-running task from a worker that stopped.
+func (e *EventManager) SendHeartbeats(
+	progress func() (Progress, bool),
+	stop chan struct{},
+	done chan struct{},
+) {
+	defer close(done)
+
+	if e.heartbeatInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		p, running := progress()
+		if !running {
+			continue
+		}
+		if err := e.SendExecutorOnHeartbeatEvent(p); err != nil {
+			slog.Error("cannot send executor_on_heartbeat event:", "err", err)
+		}
+	}
+}
+
+// batchReady reports whether the unacknowledged events should be transmitted
+// at time now according to the batch policy.
+func (e *EventManager) batchReady(now time.Time) bool {
+	e.cachedEventsLock.RLock()
+	defer e.cachedEventsLock.RUnlock()
+
+	count := len(e.cachedEvents) - e.acknowledged
+	if count <= 0 {
+		return false
+	}
+	size := 0
+	for _, event := range e.cachedEvents[e.acknowledged:] {
+		size += encodedSize(event)
+	}
+
+	return e.batchPolicy.ready(count, size, e.receivedAt[e.acknowledged], now)
+}
+
+// nextTransmission returns how long to wait from now before checking again
+// whether events should be transmitted. If not batching, that is the response
+// interval. If batching, it is the time left until the oldest unacknowledged
+// event must be transmitted; events reaching the other limits of the batch
+// policy are transmitted as they are cached. No transmission is attempted
+// before retryAt.
+func (e *EventManager) nextTransmission(now time.Time, retryAt time.Time) time.Duration {
+	wait := e.responseInterval
+	if e.batchPolicy.Enabled() {
+		e.cachedEventsLock.RLock()
+		if e.acknowledged < len(e.cachedEvents) {
+			if deadline := e.batchPolicy.deadline(e.receivedAt[e.acknowledged]); !deadline.IsZero() {
+				wait = deadline.Sub(now)
 			}
+		}
+		e.cachedEventsLock.RUnlock()
+	}
 
-			cachedEvents := append([]json.RawMessage{}, e.cachedEvents[batchStart:batchEnd]...)
-			e.cachedEventsLock.RUnlock()
-			slog.Info(
-				"transmitting cached events:",
-				"batchStart",
-				batchStart,
-				"batchEnd",
-				batchEnd,
-			)
-			if err := e.transmitEvents(cachedEvents); err != nil {
-				slog.Error("cannot transmit events:", "err", err)
-				continue
+	return max(wait, retryAt.Sub(now), 0)
+}
+
+// transmitUnacknowledged transmits the cached events that the server has not
+// yet acknowledged, split into batches according to the batch policy. Events
+// are cached in the order they are received and acknowledged in the same
+// order, so the acknowledged events are always the first ones in the cache.
+// If the server responds with 409 Conflict, it has lost track of the events it
+// acknowledged, and every cached event is sent again by the next
+// transmission.
+func (e *EventManager) transmitUnacknowledged() error {
+	e.cachedEventsLock.RLock()
+	batchStart := e.acknowledged
+	cachedEvents := append([]json.RawMessage{}, e.cachedEvents[batchStart:]...)
+	e.cachedEventsLock.RUnlock()
+
+	for _, batch := range e.batchPolicy.split(cachedEvents) {
+		batchEnd := batchStart + len(batch)
+		slog.Info(
+			"transmitting cached events:",
+			"batchStart",
+			batchStart,
+			"batchEnd",
+			batchEnd,
+		)
+		if err := e.transmitEvents(batch); err != nil {
+			var respErr *responseError
+			if errors.As(err, &respErr) && respErr.code == http.StatusConflict {
+				slog.Warn("server requested a full resend of events")
+				e.acknowledge(0)
+			}
+			return err
+		}
+		e.acknowledge(batchEnd)
+		batchStart = batchEnd
+	}
+
+	return nil
+}
+
+// acknowledge records that the server has acknowledged the first n cached
+// events.
+func (e *EventManager) acknowledge(n int) {
+	e.cachedEventsLock.Lock()
+	e.acknowledged = n
+	e.cachedEventsLock.Unlock()
+
+	if e.outbox != nil {
+		if err := e.outbox.Acknowledge(n); err != nil {
+			slog.Error("cannot record acknowledged events:", "err", err)
+		}
+	}
+}
+
+// Resend marks every cached event as unacknowledged, so that the next
+// transmission sends all of them again.
+func (e *EventManager) Resend() {
+	e.acknowledge(0)
+}
+
+// flush transmits every unacknowledged event, retrying with exponential
+// backoff up to attempts times while the failure is temporary. A Retry-After
+// delay requested by the server is honored, up to the response interval.
+// Retrying stops as soon as ctx is cancelled.
+func (e *EventManager) flush(ctx context.Context, attempts int) error {
+	backoff := outbox.DefaultBackoff()
+	for attempt := 1; ; attempt++ {
+		err := e.transmitUnacknowledged()
+		if err == nil {
+			return nil
+		}
+
+		var retryAfter time.Duration
+		var respErr *responseError
+		if errors.As(err, &respErr) {
+			if !outbox.Retryable(respErr.code) {
+				return err
 			}
+			retryAfter = e.retryAfter(respErr, time.Now())
+		}
+		if attempt >= attempts {
+			return fmt.Errorf("cannot transmit events after %v attempts: %w", attempts, err)
+		}
+
+		delay := backoff.Next(retryAfter)
+		slog.Warn("cannot transmit events, retrying:", "attempt", attempt, "delay", delay, "err", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, fmt.Errorf("cannot transmit events: %w", context.Cause(ctx)))
+		}
+	}
+}
+
+// retryAfter returns the delay before the next transmission requested by the
+// server in respErr, capped at the response interval, if there is one.
+func (e *EventManager) retryAfter(respErr *responseError, now time.Time) time.Duration {
+	retryAfter := outbox.RetryAfter(respErr.metadata, now)
+	if e.responseInterval > 0 {
+		retryAfter = min(retryAfter, e.responseInterval)
+	}
+	return retryAfter
+}
 
-			batchStart = batchEnd
+// removeOutbox removes the EventManager's outbox, if it has one, after its
+// events have been acknowledged.
+func (e *EventManager) removeOutbox() {
+	if e.outbox == nil {
+		return
+	}
+	if err := e.outbox.Remove(); err != nil {
+		slog.Error("cannot remove outbox:", "err", err)
+	}
+}
+
+// closeOutbox closes the EventManager's outbox, if it has one, leaving its
+// events on disk.
+func (e *EventManager) closeOutbox() {
+	if e.outbox == nil {
+		return
+	}
+	if err := e.outbox.Close(); err != nil {
+		slog.Error("cannot close outbox:", "err", err)
+	}
+}
+
+// DrainOutbox transmits the events left in o by a previous worker process,
+// removing o once the server acknowledges or rejects them. If the events
+// cannot be transmitted before ctx is cancelled, o is left on disk and an error
+// is returned.
+func DrainOutbox(ctx context.Context, t transmit.Transmitter, o *outbox.Outbox) error {
+	events, err := o.Events()
+	if err != nil {
+		return err
+	}
+
+	if len(events) > 0 {
+		e := NewEventManager(o.MessageID, o.CorrelationID, o.ReturnURL, 0, t, nil, nil)
+		e.cachedEvents = events
+		e.receivedAt = make([]time.Time, len(events))
+		e.acknowledged = min(o.Acknowledged(), len(events))
+		e.outbox = o
+		if err := e.flush(ctx, drainTransmitAttempts); err != nil {
+			if rejected(err) {
+				return errors.Join(err, o.Remove())
+			}
+			if closeErr := o.Close(); closeErr != nil {
+				slog.Error("cannot close outbox:", "err", closeErr)
+			}
+			return err
 		}
 	}
+
+	return o.Remove()
+}
+
+// AppendExecutorOnFailedEvent records an executor_on_failed event in o, so that
+// it is transmitted by DrainOutbox after the other events of the outbox. It
+// reports the failure of a run that cannot send the event itself, such as a run
+// interrupted by the worker exiting.
+func AppendExecutorOnFailedEvent(o *outbox.Outbox, errorKey string, errorDetails error) error {
+	event := generateExecutorOnFailedEvent(o.CorrelationID, errorKey, errorDetails, uuid.New)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("cannot marshal JSON: err=%w", err)
+	}
+	return o.Append(data)
 }
 
 // transmitEvents sends a slice of json.RawMessage values as an HTTP multipart
-// request body and sends it via a D-Bus
-// com.redhat.Yggdrasil1.Dispatcher1.Transmit method call.
+// request body through the EventManager's transmitter.
 func (e *EventManager) transmitEvents(events []json.RawMessage) error {
 	// Build a JSONL data buffer.
 	body := strings.Builder{}
@@ -143,12 +503,13 @@ func (e *EventManager) transmitEvents(events []json.RawMessage) error {
 	requestBody, outerContentType, err := buildRequestBody(
 		body.String(),
 		"runner-events",
+		e.compress,
 	)
 	if err != nil {
 		return fmt.Errorf("cannot build request body: err=%w", err)
 	}
 
-	responseCode, responseMetadata, responseBody, err := e.worker.Transmit(
+	responseCode, responseMetadata, responseBody, err := e.transmitter.Transmit(
 		e.returnURL,
 		uuid.New().String(),
 		e.messageId,
@@ -169,20 +530,19 @@ func (e *EventManager) transmitEvents(events []json.RawMessage) error {
 
 	if responseCode >= 400 {
 		// return an error if HTTP status code is 400 and up
-		return fmt.Errorf(
-			"server returned error response: code=%v responseMetadata=%v responseBody=%v",
-			responseCode,
-			responseMetadata,
-			string(responseBody),
-		)
+		return &responseError{
+			code:     responseCode,
+			metadata: responseMetadata,
+			body:     responseBody,
+		}
 	}
 
 	return nil
 }
 
 // sendExecutorOnStartEvent generates an executor_on_start event and sends it on the Events channel
-func (e *EventManager) SendExecutorOnStartEvent() error {
-	event := generateExecutorOnStartEvent(e.correlationId, uuid.New)
+func (e *EventManager) SendExecutorOnStartEvent(signingKeys []string) error {
+	event := generateExecutorOnStartEvent(e.correlationId, signingKeys, uuid.New)
 	return e.sendExecutorEvent(event)
 }
 
@@ -196,8 +556,29 @@ func (e *EventManager) SendExecutorOnFailedEvent(errorKey string, errorDetails e
 	return e.sendExecutorEvent(event)
 }
 
+// SendExecutorOnCompleteEvent generates an executor_on_complete event and sends it on the Events channel
+func (e *EventManager) SendExecutorOnCompleteEvent(result Result) error {
+	event := generateExecutorOnCompleteEvent(e.correlationId, result, uuid.New)
+	return e.sendExecutorEvent(event)
+}
+
+// SendExecutorOnHeartbeatEvent generates an executor_on_heartbeat event and sends it on the Events channel
+func (e *EventManager) SendExecutorOnHeartbeatEvent(progress Progress) error {
+	event := generateExecutorOnHeartbeatEvent(e.correlationId, progress, uuid.New)
+	return e.sendExecutorEvent(event)
+}
+
+// SendExecutorOnQueuedEvent generates an executor_on_queued event and sends it on the Events channel
+func (e *EventManager) SendExecutorOnQueuedEvent(position int) error {
+	event := generateExecutorOnQueuedEvent(e.correlationId, position, uuid.New)
+	return e.sendExecutorEvent(event)
+}
+
 // sendExecutorEvent marshals an event and sends it on the Events channel
 func (e *EventManager) sendExecutorEvent(event map[string]any) error {
+	if e.checkMode {
+		event["event_data"].(map[string]any)["crc_dispatcher_check_mode"] = true
+	}
 	data, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("cannot marshal JSON: err=%w", err)
@@ -207,11 +588,21 @@ func (e *EventManager) sendExecutorEvent(event map[string]any) error {
 }
 
 // generateExecutorOnStartEvent creates a special executor_on_start event
-// to inform Insights that the Ansible job is beginning.
+// to inform Insights that the Ansible job is beginning. If the playbook's
+// signature was verified, signingKeys are the fingerprints of the keys that
+// signed it.
 func generateExecutorOnStartEvent(
 	correlationID string,
+	signingKeys []string,
 	uuidNew createUuidFunc,
 ) map[string]any {
+	eventData := map[string]any{
+		"crc_dispatcher_correlation_id": correlationID,
+	}
+	if len(signingKeys) > 0 {
+		eventData["crc_dispatcher_signing_key_fingerprint"] = strings.Join(signingKeys, ",")
+	}
+
 	return map[string]any{
 		"event":      "executor_on_start",
 		"uuid":       uuidNew().String(),
@@ -219,9 +610,7 @@ func generateExecutorOnStartEvent(
 		"stdout":     "",
 		"start_line": 0,
 		"end_line":   0,
-		"event_data": map[string]any{
-			"crc_dispatcher_correlation_id": correlationID,
-		},
+		"event_data": eventData,
 	}
 }
 
@@ -247,9 +636,89 @@ func generateExecutorOnFailedEvent(
 	}
 }
 
+// generateExecutorOnCompleteEvent creates a special executor_on_complete
+// event to inform Insights that the Ansible job completed, summarizing its
+// outcome.
+func generateExecutorOnCompleteEvent(
+	correlationID string,
+	result Result,
+	uuidNew createUuidFunc,
+) map[string]any {
+	hosts := result.Hosts
+	if hosts == nil {
+		hosts = map[string]HostTotals{}
+	}
+
+	return map[string]any{
+		"event":      "executor_on_complete",
+		"uuid":       uuidNew().String(),
+		"counter":    -1,
+		"stdout":     "",
+		"start_line": 0,
+		"end_line":   0,
+		"event_data": map[string]any{
+			"crc_dispatcher_correlation_id": correlationID,
+			"crc_dispatcher_status":         result.Status,
+			"crc_dispatcher_rc":             result.RC,
+			"crc_dispatcher_duration":       result.Duration.Seconds(),
+			"crc_dispatcher_hosts":          hosts,
+		},
+	}
+}
+
+// generateExecutorOnHeartbeatEvent creates a special executor_on_heartbeat
+// event to inform Insights that the Ansible job is still running.
+func generateExecutorOnHeartbeatEvent(
+	correlationID string,
+	progress Progress,
+	uuidNew createUuidFunc,
+) map[string]any {
+	eventData := map[string]any{
+		"crc_dispatcher_correlation_id": correlationID,
+		"crc_dispatcher_elapsed":        progress.Elapsed.Seconds(),
+		"crc_dispatcher_pid":            progress.PID,
+	}
+	if progress.Task != "" {
+		eventData["crc_dispatcher_task"] = progress.Task
+	}
+
+	return map[string]any{
+		"event":      "executor_on_heartbeat",
+		"uuid":       uuidNew().String(),
+		"counter":    -1,
+		"stdout":     "",
+		"start_line": 0,
+		"end_line":   0,
+		"event_data": eventData,
+	}
+}
+
+// generateExecutorOnQueuedEvent creates a special executor_on_queued event
+// to inform Insights that the Ansible job is waiting for other jobs to finish.
+// position is the number of jobs ahead of it in the queue.
+func generateExecutorOnQueuedEvent(
+	correlationID string,
+	position int,
+	uuidNew createUuidFunc,
+) map[string]any {
+	return map[string]any{
+		"event":      "executor_on_queued",
+		"uuid":       uuidNew().String(),
+		"counter":    -1,
+		"stdout":     "",
+		"start_line": 0,
+		"end_line":   0,
+		"event_data": map[string]any{
+			"crc_dispatcher_correlation_id": correlationID,
+			"crc_dispatcher_queue_position": position,
+		},
+	}
+}
+
 // buildRequestBody assembles a multipart/mixed HTTP request body suitable for
-// uploading to ingress.
-func buildRequestBody(body string, filename string) (*bytes.Buffer, string, error) {
+// uploading to ingress. If compress is true, the body is gzip compressed and
+// the part is marked with a "gzip" Content-Encoding.
+func buildRequestBody(body string, filename string, compress bool) (*bytes.Buffer, string, error) {
 	requestBody := &bytes.Buffer{}
 	writer := multipart.NewWriter(requestBody)
 	defer func() {
@@ -264,18 +733,35 @@ func buildRequestBody(body string, filename string) (*bytes.Buffer, string, erro
 	innerContentType := "application/vnd.redhat.playbook.v1+jsonl"
 	contentDisposition := fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename)
 
+	if compress {
+		contentDisposition = fmt.Sprintf(`form-data; name="file"; filename="%s.gz"`, filename)
+	}
+
 	h := make(textproto.MIMEHeader)
 	h.Set("Content-Disposition", contentDisposition)
 	h.Set("Content-Type", innerContentType)
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+	}
 
 	part, err := writer.CreatePart(h)
 	if err != nil {
 		return nil, "", fmt.Errorf("cannot create form part: %v", err)
 	}
 
-	_, err = io.WriteString(part, body)
-	if err != nil {
-		return nil, "", fmt.Errorf("cannot write body to form part: %v", err)
+	if compress {
+		gz := gzip.NewWriter(part)
+		if _, err := io.WriteString(gz, body); err != nil {
+			return nil, "", fmt.Errorf("cannot write compressed body to form part: %v", err)
+		}
+		if err := gz.Close(); err != nil {
+			return nil, "", fmt.Errorf("cannot write compressed body to form part: %v", err)
+		}
+	} else {
+		_, err = io.WriteString(part, body)
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot write body to form part: %v", err)
+		}
 	}
 
 	outerContentType := fmt.Sprintf("multipart/form-data; boundary=%s", writer.Boundary())
@@ -0,0 +1,170 @@
+package ansible
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redhatinsights/rhc-worker-playbook/internal/constants"
+)
+
+// HostTotals are the number of task results of each kind on a host, as
+// reported by the playbook_on_stats event.
+type HostTotals struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Failed      int `json:"failed"`
+	Skipped     int `json:"skipped"`
+	Unreachable int `json:"unreachable"`
+}
+
+// Result summarizes a completed playbook run.
+type Result struct {
+	// Status is the final status reported by ansible-runner.
+	Status string
+
+	// RC is the return code of ansible-playbook, or -1 if it is unknown.
+	RC int
+
+	// Duration is the wall-clock duration of the run.
+	Duration time.Duration
+
+	// Hosts maps each host to its task result totals. It is empty if the
+	// playbook_on_stats event could not be read.
+	Hosts map[string]HostTotals
+}
+
+// statsEvent is the part of a playbook_on_stats job event holding the
+// per-host totals.
+type statsEvent struct {
+	Event     string `json:"event"`
+	EventData struct {
+		Ok       map[string]int `json:"ok"`
+		Changed  map[string]int `json:"changed"`
+		Failures map[string]int `json:"failures"`
+		Skipped  map[string]int `json:"skipped"`
+		Dark     map[string]int `json:"dark"`
+	} `json:"event_data"`
+}
+
+// readRC reads the return code written by ansible-runner to the rc file at
+// path.
+func readRC(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return -1, fmt.Errorf("cannot read rc file: path=%v err=%w", path, err)
+	}
+	rc, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1, fmt.Errorf("cannot parse rc file: path=%v err=%w", path, err)
+	}
+	return rc, nil
+}
+
+// readHostTotals finds the playbook_on_stats event among the job events in
+// dir and returns its per-host totals. The stats event is normally the last
+// one, so the events are searched from the highest counter down.
+func readHostTotals(dir string) (map[string]HostTotals, error) {
+	paths, err := jobEventFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range slices.Backward(paths) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read file: path=%v err=%w", path, err)
+		}
+		var event statsEvent
+		if err := json.Unmarshal(data, &event); err != nil || event.Event != "playbook_on_stats" {
+			continue
+		}
+		return event.hostTotals(), nil
+	}
+
+	return nil, fmt.Errorf("cannot find playbook_on_stats event: directory=%v", dir)
+}
+
+// ReadJobEvents returns the job events written by ansible-runner for the run
+// identified by correlationId, in the order they occurred.
+func ReadJobEvents(correlationId string) ([]json.RawMessage, error) {
+	paths, err := jobEventFiles(
+		filepath.Join(constants.PrivateDataDir, "artifacts", correlationId, "job_events"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]json.RawMessage, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read file: path=%v err=%w", path, err)
+		}
+		events = append(events, json.RawMessage(bytes.TrimSpace(data)))
+	}
+	return events, nil
+}
+
+// jobEventFiles returns the paths of the complete job event files in dir,
+// ordered by their counter. ansible-runner names job event files after their
+// counter and writes partial events to files that are later renamed.
+func jobEventFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read job_events directory: directory=%v err=%w", dir, err)
+	}
+
+	type eventFile struct {
+		counter int
+		name    string
+	}
+	var files []eventFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") || strings.Contains(name, "partial") {
+			continue
+		}
+		prefix, _, _ := strings.Cut(name, "-")
+		counter, err := strconv.Atoi(prefix)
+		if err != nil {
+			continue
+		}
+		files = append(files, eventFile{counter: counter, name: name})
+	}
+	slices.SortFunc(files, func(a, b eventFile) int {
+		return cmp.Compare(a.counter, b.counter)
+	})
+
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, filepath.Join(dir, file.name))
+	}
+	return paths, nil
+}
+
+// hostTotals converts the per-category maps of the stats event into totals
+// per host.
+func (e statsEvent) hostTotals() map[string]HostTotals {
+	totals := map[string]HostTotals{}
+	add := func(counts map[string]int, field func(*HostTotals) *int) {
+		for host, count := range counts {
+			t := totals[host]
+			*field(&t) += count
+			totals[host] = t
+		}
+	}
+	add(e.EventData.Ok, func(t *HostTotals) *int { return &t.Ok })
+	add(e.EventData.Changed, func(t *HostTotals) *int { return &t.Changed })
+	add(e.EventData.Failures, func(t *HostTotals) *int { return &t.Failed })
+	add(e.EventData.Skipped, func(t *HostTotals) *int { return &t.Skipped })
+	add(e.EventData.Dark, func(t *HostTotals) *int { return &t.Unreachable })
+	return totals
+}
@@ -48,6 +48,16 @@ type PlaybookRunResponseMessageEventsElemEventData struct {
 	// "crc_dispatcher_error_details".
 	CrcDispatcherErrorDetails *string `json:"crc_dispatcher_error_details,omitempty"`
 
+	// CrcDispatcherCheckMode is true if the event is part of a run executed in
+	// check mode. It is not part of the playbook dispatcher schema; it marks
+	// dry runs so that they can be told apart from runs that made changes.
+	CrcDispatcherCheckMode *bool `json:"crc_dispatcher_check_mode,omitempty"`
+
+	// CrcDispatcherRedactions is the number of times sensitive data was masked
+	// in the event. It is not part of the playbook dispatcher schema; it makes
+	// visible that the event does not hold the original output.
+	CrcDispatcherRedactions *int `json:"crc_dispatcher_redactions,omitempty"`
+
 	// Host corresponds to the JSON schema field "host".
 	Host *string `json:"host,omitempty"`
 
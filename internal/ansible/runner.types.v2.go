@@ -0,0 +1,149 @@
+// Version 2 of the job event message schema. It extends the playbook
+// dispatcher schema of version 1 with the task and result details needed to
+// follow a run without reading its stdout.
+
+package ansible
+
+// Job event message schema versions, recorded in the "crc_message_version"
+// field of each job event.
+const (
+	MessageVersion1 = 1
+	MessageVersion2 = 2
+)
+
+// MessageVersions lists the supported job event message schema versions.
+var MessageVersions = []int{MessageVersion1, MessageVersion2}
+
+// Overall structure of the data in an ansible job event in version 2 of the
+// message schema
+type PlaybookRunResponseMessageEventsElemV2 struct {
+	// Counter corresponds to the JSON schema field "counter".
+	Counter int `json:"counter"`
+
+	// EndLine corresponds to the JSON schema field "end_line".
+	EndLine int `json:"end_line"`
+
+	// Event corresponds to the JSON schema field "event".
+	Event string `json:"event"`
+
+	// EventData corresponds to the JSON schema field "event_data".
+	EventData *PlaybookRunResponseMessageEventsElemEventDataV2 `json:"event_data,omitempty"`
+
+	// StartLine corresponds to the JSON schema field "start_line".
+	StartLine int `json:"start_line"`
+
+	// Stdout corresponds to the JSON schema field "stdout".
+	Stdout *string `json:"stdout,omitempty"`
+
+	// Uuid corresponds to the JSON schema field "uuid".
+	Uuid string `json:"uuid"`
+
+	// RunnerIdent corresponds to the JSON schema field "runner_ident".
+	RunnerIdent string `json:"runner_ident"`
+
+	// ParentUuid is the uuid of the event this event is nested in, such as
+	// the task start event of a task result.
+	ParentUuid *string `json:"parent_uuid,omitempty"`
+
+	// Created is the time at which ansible-runner created the event.
+	Created *string `json:"created,omitempty"`
+}
+
+// Structure of the "event_data" field in an ansible job event in version 2 of
+// the message schema
+type PlaybookRunResponseMessageEventsElemEventDataV2 struct {
+	// CrcMessageVersion is the version of the message schema.
+	CrcMessageVersion int `json:"crc_message_version"`
+
+	// CrcDispatcherCorrelationId corresponds to the JSON schema field
+	// "crc_dispatcher_correlation_id".
+	CrcDispatcherCorrelationId *string `json:"crc_dispatcher_correlation_id,omitempty"`
+
+	// CrcDispatcherErrorCode corresponds to the JSON schema field
+	// "crc_dispatcher_error_code".
+	CrcDispatcherErrorCode *string `json:"crc_dispatcher_error_code,omitempty"`
+
+	// CrcDispatcherErrorDetails corresponds to the JSON schema field
+	// "crc_dispatcher_error_details".
+	CrcDispatcherErrorDetails *string `json:"crc_dispatcher_error_details,omitempty"`
+
+	// CrcDispatcherCheckMode is true if the event is part of a run executed in
+	// check mode.
+	CrcDispatcherCheckMode *bool `json:"crc_dispatcher_check_mode,omitempty"`
+
+	// CrcDispatcherRedactions is the number of times sensitive data was masked
+	// in the event.
+	CrcDispatcherRedactions *int `json:"crc_dispatcher_redactions,omitempty"`
+
+	// Host is the host the event is about.
+	Host *string `json:"host,omitempty"`
+
+	// Playbook is the path of the playbook.
+	Playbook *string `json:"playbook,omitempty"`
+
+	// PlaybookUuid identifies the playbook run.
+	PlaybookUuid *string `json:"playbook_uuid,omitempty"`
+
+	// Play is the name of the play.
+	Play *string `json:"play,omitempty"`
+
+	// PlayUuid identifies the play.
+	PlayUuid *string `json:"play_uuid,omitempty"`
+
+	// Task is the name of the task.
+	Task *string `json:"task,omitempty"`
+
+	// TaskUuid identifies the task.
+	TaskUuid *string `json:"task_uuid,omitempty"`
+
+	// TaskAction is the module run by the task, as written in the playbook.
+	TaskAction *string `json:"task_action,omitempty"`
+
+	// ResolvedAction is the fully qualified name of the module run by the
+	// task.
+	ResolvedAction *string `json:"resolved_action,omitempty"`
+
+	// Role is the name of the role the task belongs to.
+	Role *string `json:"role,omitempty"`
+
+	// Start is the time at which the task started on the host.
+	Start *string `json:"start,omitempty"`
+
+	// End is the time at which the task finished on the host.
+	End *string `json:"end,omitempty"`
+
+	// Duration is the number of seconds the task ran on the host.
+	Duration *float64 `json:"duration,omitempty"`
+
+	// Res is the result of the task on the host.
+	Res *PlaybookRunResponseMessageEventsElemResultV2 `json:"res,omitempty"`
+
+	// Ok, Changed, Failures, Dark, Skipped, Rescued and Ignored are the
+	// per-host totals of a playbook_on_stats event.
+	Ok       map[string]int `json:"ok,omitempty"`
+	Changed  map[string]int `json:"changed,omitempty"`
+	Failures map[string]int `json:"failures,omitempty"`
+	Dark     map[string]int `json:"dark,omitempty"`
+	Skipped  map[string]int `json:"skipped,omitempty"`
+	Rescued  map[string]int `json:"rescued,omitempty"`
+	Ignored  map[string]int `json:"ignored,omitempty"`
+}
+
+// Structure of the "res" field of the "event_data" of a task result in
+// version 2 of the message schema
+type PlaybookRunResponseMessageEventsElemResultV2 struct {
+	// Changed is true if the task changed the host.
+	Changed *bool `json:"changed,omitempty"`
+
+	// Failed is true if the task failed.
+	Failed *bool `json:"failed,omitempty"`
+
+	// Skipped is true if the task was skipped.
+	Skipped *bool `json:"skipped,omitempty"`
+
+	// Unreachable is true if the host could not be reached.
+	Unreachable *bool `json:"unreachable,omitempty"`
+
+	// Msg is the message returned by the module, either a string or a list.
+	Msg any `json:"msg,omitempty"`
+}
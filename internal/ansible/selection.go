@@ -0,0 +1,86 @@
+package ansible
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Event selection presets.
+const (
+	// EventPresetFull selects every job event.
+	EventPresetFull = "full"
+
+	// EventPresetSummary selects the task results and the start and end of
+	// the playbook and its plays, leaving out the high-volume events marking
+	// the start of each task and host.
+	EventPresetSummary = "summary"
+
+	// EventPresetFailuresOnly selects failed task results and the final
+	// stats of the playbook.
+	EventPresetFailuresOnly = "failures-only"
+)
+
+// eventPresets maps the presets other than EventPresetFull to the job event
+// types they select.
+var eventPresets = map[string][]string{
+	EventPresetSummary: {
+		"playbook_on_start",
+		"playbook_on_play_start",
+		"runner_on_ok",
+		"runner_on_failed",
+		"runner_on_skipped",
+		"runner_on_unreachable",
+		"runner_on_async_ok",
+		"runner_on_async_failed",
+		"runner_item_on_ok",
+		"runner_item_on_failed",
+		"runner_item_on_skipped",
+		"playbook_on_stats",
+	},
+	EventPresetFailuresOnly: {
+		"runner_on_failed",
+		"runner_on_unreachable",
+		"runner_on_async_failed",
+		"runner_item_on_failed",
+		"playbook_on_stats",
+	},
+}
+
+// EventSelection selects the job events of a run that are transmitted. The
+// events selected by Preset are extended with the event types in Include, then
+// the event types in Exclude are removed. Executor events ("executor_on_*")
+// are not job events and are always transmitted.
+type EventSelection struct {
+	Preset  string
+	Include []string
+	Exclude []string
+}
+
+// Validate returns an error if the selection's preset is unknown.
+func (s EventSelection) Validate() error {
+	if s.Preset == "" || s.Preset == EventPresetFull {
+		return nil
+	}
+	if _, has := eventPresets[s.Preset]; !has {
+		return fmt.Errorf("unknown event preset: %v", s.Preset)
+	}
+	return nil
+}
+
+// selects reports whether job events of type eventType are transmitted.
+func (s EventSelection) selects(eventType string) bool {
+	if strings.HasPrefix(eventType, "executor_on_") {
+		return true
+	}
+	if slices.Contains(s.Exclude, eventType) {
+		return false
+	}
+	if slices.Contains(s.Include, eventType) {
+		return true
+	}
+	if s.Preset == "" || s.Preset == EventPresetFull {
+		return true
+	}
+	return slices.Contains(eventPresets[s.Preset], eventType)
+}
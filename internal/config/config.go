@@ -1,13 +1,62 @@
 package config
 
-import "time"
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/redhatinsights/rhc-worker-playbook/internal/constants"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/redact"
+)
 
 const (
-	FlagNameDirective        = "directive"
-	FlagNameLogLevel         = "log-level"
-	FlagNameVerifyPlaybook   = "verify-playbook"
-	FlagNameResponseInterval = "response-interval"
-	FlagNameBatchEvents      = "batch-events"
+	FlagNameDirective          = "directive"
+	FlagNameLogLevel           = "log-level"
+	FlagNameVerifyPlaybook     = "verify-playbook"
+	FlagNameResponseInterval   = "response-interval"
+	FlagNameBatchEvents        = "batch-events"
+	FlagNameBatchBytes         = "batch-bytes"
+	FlagNameBatchLatency       = "batch-latency"
+	FlagNameCompressEvents     = "compress-events"
+	FlagNameRedactPatterns     = "redact-patterns"
+	FlagNameEventPreset        = "event-preset"
+	FlagNameEventInclude       = "event-include"
+	FlagNameEventExclude       = "event-exclude"
+	FlagNameHeartbeatInterval  = "heartbeat-interval"
+	FlagNameExecutionTimeout   = "execution-timeout"
+	FlagNameQueueDepth         = "queue-depth"
+	FlagNameExtraVarsAllowlist = "extra-vars-allowlist"
+	FlagNameVerifyBackend      = "verify-backend"
+	FlagNameVerifyKeyringDir   = "verify-keyring-dir"
+	FlagNamePolicyFile         = "policy-file"
+	FlagNameTransmitter        = "transmitter"
+	FlagNameTransmitFile       = "transmit-file"
+	FlagNameTransmitURL        = "transmit-url"
+
+	FlagNameRetentionMaxAge         = "retention-max-age"
+	FlagNameRetentionMaxRuns        = "retention-max-runs"
+	FlagNameRetentionMaxBytes       = "retention-max-bytes"
+	FlagNameRetentionKeepFailedOnly = "retention-keep-failed-only"
+)
+
+// Playbook signature verification backends.
+const (
+	// VerifyBackendNative verifies signatures in-process.
+	VerifyBackendNative = "native"
+
+	// VerifyBackendSubprocess verifies signatures by running
+	// rhc-playbook-verifier.
+	VerifyBackendSubprocess = "subprocess"
+)
+
+const (
+	// TransmitterDBus transmits events through the yggdrasil dispatcher.
+	TransmitterDBus = "dbus"
+
+	// TransmitterFile appends events to a local file.
+	TransmitterFile = "file"
+
+	// TransmitterHTTP posts events to a local HTTP endpoint.
+	TransmitterHTTP = "http"
 )
 
 type Config struct {
@@ -28,14 +77,125 @@ type Config struct {
 	// BatchEvents is the number of events to batch together in a given transmit
 	// response.
 	BatchEvents int
+
+	// BatchBytes is the size in bytes of the encoded events to batch together
+	// in a given transmit response.
+	BatchBytes int
+
+	// BatchLatency is the longest an event may wait to be transmitted when
+	// batching events. If zero, the response interval is used.
+	BatchLatency time.Duration
+
+	// CompressEvents determines whether or not to gzip compress the events
+	// uploaded to ingress. Messages may also request compression with the
+	// "accept_encoding" metadata key.
+	CompressEvents bool
+
+	// RedactPatterns are the regular expressions matching sensitive data that
+	// is masked in job events before they are transmitted.
+	RedactPatterns []string
+
+	// EventPreset names the set of job event types transmitted: "full",
+	// "summary" or "failures-only". It can be overridden per message with the
+	// "event_preset" metadata key.
+	EventPreset string
+
+	// EventInclude lists job event types transmitted in addition to those
+	// selected by EventPreset. It can be overridden per message with the
+	// "event_include" metadata key.
+	EventInclude []string
+
+	// EventExclude lists job event types that are never transmitted. It can
+	// be overridden per message with the "event_exclude" metadata key.
+	EventExclude []string
+
+	// HeartbeatInterval is the time between the "executor_on_heartbeat"
+	// events sent while a playbook is running. A zero value disables
+	// heartbeats.
+	HeartbeatInterval time.Duration
+
+	// ExecutionTimeout is the default maximum duration of a playbook run. It
+	// can be overridden per message with the "timeout" metadata key. A zero
+	// value disables the timeout.
+	ExecutionTimeout time.Duration
+
+	// QueueDepth is the number of playbooks that may wait in the run queue
+	// while another playbook is running. Playbooks received while the queue is
+	// full are rejected.
+	QueueDepth int
+
+	// ExtraVarsAllowlist is the set of variable names that messages may set
+	// with the "extra_vars" metadata key.
+	ExtraVarsAllowlist []string
+
+	// VerifyBackend selects how playbook signatures are verified, either
+	// VerifyBackendNative or VerifyBackendSubprocess.
+	VerifyBackend string
+
+	// VerifyKeyringDir is the directory containing the public keys trusted by
+	// the native verification backend.
+	VerifyKeyringDir string
+
+	// PolicyFile is the path to the content policy that playbooks must
+	// satisfy before they run. If the file does not exist, every playbook is
+	// allowed.
+	PolicyFile string
+
+	// Transmitter selects where events are transmitted, either
+	// TransmitterDBus, TransmitterFile or TransmitterHTTP.
+	Transmitter string
+
+	// TransmitFile is the file events are appended to by TransmitterFile.
+	TransmitFile string
+
+	// TransmitURL is the URL events are posted to by TransmitterHTTP.
+	TransmitURL string
+
+	// RetentionMaxAge is the longest the files of a past run are kept. A zero
+	// value disables the limit.
+	RetentionMaxAge time.Duration
+
+	// RetentionMaxRuns is the number of most recent runs whose files are
+	// kept. A zero value disables the limit.
+	RetentionMaxRuns int
+
+	// RetentionMaxBytes is the total size of the files of past runs that are
+	// kept. A zero value disables the limit.
+	RetentionMaxBytes int64
+
+	// RetentionKeepFailedOnly removes the files of every successful run as
+	// soon as it completes.
+	RetentionKeepFailedOnly bool
 }
 
 // DefaultConfig is a globally accessible Config data structure, initialized
 // with default values.
 var DefaultConfig = Config{
-	Directive:        "rhc_worker_playbook",
-	LogLevel:         "error",
-	VerifyPlaybook:   true,
-	ResponseInterval: 0,
-	BatchEvents:      0,
+	Directive:          "rhc_worker_playbook",
+	LogLevel:           "error",
+	VerifyPlaybook:     true,
+	ResponseInterval:   0,
+	BatchEvents:        0,
+	BatchBytes:         0,
+	BatchLatency:       0,
+	CompressEvents:     false,
+	RedactPatterns:     redact.DefaultPatterns,
+	EventPreset:        "full",
+	EventInclude:       []string{},
+	EventExclude:       []string{},
+	HeartbeatInterval:  time.Minute,
+	ExecutionTimeout:   0,
+	QueueDepth:         5,
+	ExtraVarsAllowlist: []string{},
+	VerifyBackend:      VerifyBackendSubprocess,
+	VerifyKeyringDir:   filepath.Join(constants.ConfigDir, "keyring"),
+	PolicyFile:         filepath.Join(constants.ConfigDir, "policy.toml"),
+	Transmitter:        TransmitterDBus,
+	TransmitFile:       filepath.Join(constants.StateDir, "events.jsonl"),
+	TransmitURL:        "",
+
+	RetentionMaxAge:         0,
+	RetentionMaxRuns:        0,
+	RetentionMaxBytes:       0,
+	RetentionKeepFailedOnly: false,
 }
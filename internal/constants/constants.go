@@ -35,6 +35,9 @@ var (
 
 	// AnsibleRemoteTmpPath is a directory used by ansible-runner
 	AnsibleRemoteTmpPath string
+
+	// Python3Path is the python3 interpreter that runs ansible-runner.
+	Python3Path string
 )
 
 func init() {
@@ -81,4 +84,8 @@ func init() {
 	if AnsibleRemoteTmpPath == "" {
 		AnsibleRemoteTmpPath = filepath.Join(AnsibleHomePath, "remote-tmp")
 	}
+
+	if Python3Path == "" {
+		Python3Path = filepath.Join("/", "usr", "bin", "python3")
+	}
 }
@@ -0,0 +1,168 @@
+// Package history records the messages processed by the worker, so that the
+// runs made on a host can be reviewed after the fact.
+package history
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Get when no run matches the requested ID.
+var ErrNotFound = errors.New("run not found")
+
+// Outcomes of the verification of a playbook's signature.
+const (
+	VerificationPassed   = "passed"
+	VerificationFailed   = "failed"
+	VerificationDisabled = "disabled"
+)
+
+// Run is the record of a message processed by the worker.
+type Run struct {
+	MessageID     string `json:"message_id"`
+	CorrelationID string `json:"correlation_id"`
+	ReturnURL     string `json:"return_url"`
+
+	// PlaybookSHA256 is the hexadecimal SHA-256 digest of the playbook as
+	// received, signature included.
+	PlaybookSHA256 string `json:"playbook_sha256"`
+
+	// Verification is the outcome of the verification of the playbook's
+	// signature, or empty if the message was rejected before verification.
+	Verification string `json:"verification,omitempty"`
+
+	// SigningKeys are the fingerprints of the keys that signed the playbook,
+	// if they are known.
+	SigningKeys []string `json:"signing_keys,omitempty"`
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitzero"`
+
+	// Status is the final status of the ansible-runner run, or empty if the
+	// playbook did not run to completion.
+	Status string `json:"status,omitempty"`
+
+	// ErrorKey is the error key of the executor_on_failed event sent for the
+	// run, if any.
+	ErrorKey string `json:"error_key,omitempty"`
+
+	// TransmitOutcome describes whether the server acknowledged the run's
+	// events.
+	TransmitOutcome string `json:"transmit_outcome,omitempty"`
+}
+
+// Store is a directory of run records, one file per message.
+type Store struct {
+	dir  string
+	lock sync.Mutex
+}
+
+// Open returns the Store of run records in dir, creating dir if needed.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create history directory: directory=%v err=%w", dir, err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Save records run, replacing any previous record of the same message.
+func (s *Store) Save(run Run) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("cannot marshal run: err=%w", err)
+	}
+	path := s.path(run.MessageID)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("cannot write run: path=%v err=%w", path, err)
+	}
+	return nil
+}
+
+// List returns every recorded run, oldest first. Records that cannot be read
+// are logged and skipped.
+func (s *Store) List() ([]Run, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read history directory: directory=%v err=%w", s.dir, err)
+	}
+
+	runs := []Run{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.dir, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Warn("cannot read run:", "path", path, "err", err)
+			continue
+		}
+		var run Run
+		if err := json.Unmarshal(data, &run); err != nil {
+			slog.Warn("cannot unmarshal run:", "path", path, "err", err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+	slices.SortFunc(runs, func(a, b Run) int {
+		return cmp.Or(a.Started.Compare(b.Started), cmp.Compare(a.MessageID, b.MessageID))
+	})
+
+	return runs, nil
+}
+
+// Get returns the run whose message ID or correlation ID is id.
+func (s *Store) Get(id string) (Run, error) {
+	runs, err := s.List()
+	if err != nil {
+		return Run{}, err
+	}
+	for _, run := range runs {
+		if run.MessageID == id || run.CorrelationID == id {
+			return run, nil
+		}
+	}
+	return Run{}, fmt.Errorf("%w: %v", ErrNotFound, id)
+}
+
+// Remove removes the records of the runs whose message ID or correlation ID is
+// id. It is not an error if there are none.
+func (s *Store) Remove(id string) error {
+	runs, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, run := range runs {
+		if run.MessageID != id && run.CorrelationID != id {
+			continue
+		}
+		path := s.path(run.MessageID)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot remove run: path=%v err=%w", path, err)
+		}
+	}
+	return nil
+}
+
+// path returns the path of the record of the message identified by messageID.
+func (s *Store) path(messageID string) string {
+	return filepath.Join(s.dir, messageID+".json")
+}
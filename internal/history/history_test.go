@@ -0,0 +1,84 @@
+package history
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStore(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	second := Run{
+		MessageID:     "b",
+		CorrelationID: "correlation-b",
+		Started:       started.Add(time.Hour),
+	}
+	first := Run{
+		MessageID:      "a",
+		CorrelationID:  "correlation-a",
+		ReturnURL:      "https://example.com/api/ingress/v1/upload",
+		PlaybookSHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		Verification:   VerificationPassed,
+		SigningKeys:    []string{"567E347AD0044ADE55BA8A5F199E2F91FD431D51"},
+		Started:        started,
+	}
+	for _, run := range []Run{second, first} {
+		if err := store.Save(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Complete the first run, replacing its record.
+	first.Finished = started.Add(time.Minute)
+	first.Status = "successful"
+	first.TransmitOutcome = "acknowledged"
+	if err := store.Save(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files that are not run records are skipped.
+	if err := os.WriteFile(filepath.Join(store.dir, "invalid.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Run{first, second}; !cmp.Equal(runs, want) {
+		t.Errorf("\ngot:\n%v\nwant:\n%v", runs, want)
+	}
+
+	for _, id := range []string{"b", "correlation-b"} {
+		got, err := store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(got, second) {
+			t.Errorf("\ngot:\n%v\nwant:\n%v", got, second)
+		}
+	}
+
+	if _, err := store.Get("c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+
+	if err := store.Remove("correlation-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+	if err := store.Remove("c"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// metadataFile is the name of the file holding an outbox's Metadata.
+	metadataFile = "metadata.json"
+
+	// eventsFile is the name of the file holding an outbox's events, one JSON
+	// document per line.
+	eventsFile = "events.jsonl"
+
+	// acknowledgedFile is the name of the file holding the number of an
+	// outbox's events acknowledged by the server.
+	acknowledgedFile = "acknowledged"
+)
+
+// Metadata identifies the message whose run produced the events in an outbox,
+// and where the events are sent.
+type Metadata struct {
+	MessageID     string `json:"message_id"`
+	CorrelationID string `json:"correlation_id"`
+	ReturnURL     string `json:"return_url"`
+}
+
+// Outbox records the events of a single run on disk until the server has
+// acknowledged them. An outbox that is not removed, because the worker exited
+// before its events were acknowledged, is returned by Pending the next time
+// the worker starts.
+type Outbox struct {
+	Metadata
+
+	dir    string
+	lock   sync.Mutex
+	events *os.File
+}
+
+// Create creates an empty outbox for the run identified by metadata in a
+// subdirectory of root, replacing any existing outbox of the same message.
+func Create(root string, metadata Metadata) (*Outbox, error) {
+	dir := filepath.Join(root, metadata.MessageID)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("cannot remove outbox: directory=%v err=%w", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create outbox: directory=%v err=%w", dir, err)
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal outbox metadata: err=%w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, metadataFile), data, 0600); err != nil {
+		return nil, fmt.Errorf("cannot write outbox metadata: directory=%v err=%w", dir, err)
+	}
+
+	return open(dir, metadata)
+}
+
+// Pending returns the outboxes in root that still hold unacknowledged events.
+// Outboxes that cannot be read are logged and skipped.
+func Pending(root string) ([]*Outbox, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read outbox directory: directory=%v err=%w", root, err)
+	}
+
+	var outboxes []*Outbox
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+
+		data, err := os.ReadFile(filepath.Join(dir, metadataFile))
+		if err != nil {
+			slog.Warn("skipping unreadable outbox:", "directory", dir, "err", err)
+			continue
+		}
+		var metadata Metadata
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			slog.Warn("skipping unreadable outbox:", "directory", dir, "err", err)
+			continue
+		}
+
+		o, err := open(dir, metadata)
+		if err != nil {
+			return nil, err
+		}
+		outboxes = append(outboxes, o)
+	}
+
+	return outboxes, nil
+}
+
+// open opens the events file of the outbox in dir for appending.
+func open(dir string, metadata Metadata) (*Outbox, error) {
+	path := filepath.Join(dir, eventsFile)
+	events, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open outbox events: path=%v err=%w", path, err)
+	}
+
+	return &Outbox{Metadata: metadata, dir: dir, events: events}, nil
+}
+
+// Append records event in the outbox.
+func (o *Outbox) Append(event json.RawMessage) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	line := append(bytes.Clone(bytes.TrimSpace(event)), '\n')
+	if _, err := o.events.Write(line); err != nil {
+		return fmt.Errorf("cannot append event to outbox: directory=%v err=%w", o.dir, err)
+	}
+
+	return nil
+}
+
+// Events returns the events recorded in the outbox, in the order they were
+// appended.
+func (o *Outbox) Events() ([]json.RawMessage, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	path := filepath.Join(o.dir, eventsFile)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open outbox events: path=%v err=%w", path, err)
+	}
+	defer file.Close()
+
+	var events []json.RawMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		// A line may be truncated if the worker exited while appending it.
+		if !json.Valid(line) {
+			slog.Warn("skipping invalid outbox event:", "path", path)
+			continue
+		}
+		events = append(events, json.RawMessage(bytes.Clone(line)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read outbox events: path=%v err=%w", path, err)
+	}
+
+	return events, nil
+}
+
+// Acknowledge records that the server has acknowledged the first n events of
+// the outbox.
+func (o *Outbox) Acknowledge(n int) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	path := filepath.Join(o.dir, acknowledgedFile)
+	if err := os.WriteFile(path, []byte(strconv.Itoa(n)), 0600); err != nil {
+		return fmt.Errorf("cannot write acknowledged events: path=%v err=%w", path, err)
+	}
+
+	return nil
+}
+
+// Acknowledged returns the number of events of the outbox acknowledged by the
+// server. If the number cannot be read, none are considered acknowledged so
+// that every event is sent again.
+func (o *Outbox) Acknowledged() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	path := filepath.Join(o.dir, acknowledgedFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("cannot read acknowledged events:", "path", path, "err", err)
+		}
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || n < 0 {
+		slog.Warn("invalid acknowledged events:", "path", path, "value", string(data))
+		return 0
+	}
+
+	return n
+}
+
+// Remove deletes the outbox once its events have been acknowledged.
+func (o *Outbox) Remove() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if err := o.events.Close(); err != nil {
+		slog.Warn("cannot close outbox events:", "directory", o.dir, "err", err)
+	}
+	if err := os.RemoveAll(o.dir); err != nil {
+		return fmt.Errorf("cannot remove outbox: directory=%v err=%w", o.dir, err)
+	}
+
+	return nil
+}
+
+// Close closes the outbox, leaving its events on disk to be sent after the
+// worker restarts.
+func (o *Outbox) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if err := o.events.Close(); err != nil {
+		return fmt.Errorf("cannot close outbox events: directory=%v err=%w", o.dir, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package outbox
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOutbox(t *testing.T) {
+	root := t.TempDir()
+	metadata := Metadata{
+		MessageID:     "5c2ecb5a-5f3a-4ac5-8c12-1a3b8f6d2f40",
+		CorrelationID: "dcdc7b28-6800-4af9-983a-60fda58a7156",
+		ReturnURL:     "https://cert-api.example.com/api/ingress/v1/upload",
+	}
+
+	o, err := Create(root, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []json.RawMessage{
+		json.RawMessage(`{"event":"executor_on_start","counter":-1}`),
+		json.RawMessage(`{"event":"playbook_on_start","counter":1}` + "\n"),
+	}
+	for _, event := range events {
+		if err := o.Append(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the worker exiting while appending an event.
+	path := filepath.Join(root, metadata.MessageID, eventsFile)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"event":"runner_on_`); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := Pending(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("got %v pending outboxes, want 1", len(pending))
+	}
+	if !cmp.Equal(pending[0].Metadata, metadata) {
+		t.Errorf("%#v != %#v", pending[0].Metadata, metadata)
+	}
+
+	got, err := pending[0].Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []json.RawMessage{
+		json.RawMessage(`{"event":"executor_on_start","counter":-1}`),
+		json.RawMessage(`{"event":"playbook_on_start","counter":1}`),
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%s != %s", got, want)
+	}
+
+	if n := pending[0].Acknowledged(); n != 0 {
+		t.Errorf("got %v acknowledged events, want 0", n)
+	}
+	if err := pending[0].Acknowledge(2); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending[0].Acknowledged(); n != 2 {
+		t.Errorf("got %v acknowledged events, want 2", n)
+	}
+
+	if err := pending[0].Remove(); err != nil {
+		t.Fatal(err)
+	}
+	pending, err = Pending(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("got %v pending outboxes, want 0", len(pending))
+	}
+}
+
+func TestPendingMissingDirectory(t *testing.T) {
+	pending, err := Pending(filepath.Join(t.TempDir(), "outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("got %v pending outboxes, want 0", len(pending))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := &Backoff{Initial: time.Second, Max: 10 * time.Second}
+
+	var got []time.Duration
+	for range 5 {
+		got = append(got, b.Next(0))
+	}
+	got = append(got, b.Next(time.Minute))
+	b.Reset()
+	got = append(got, b.Next(0))
+	got = append(got, b.Next(5*time.Second))
+
+	want := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+		time.Second,
+		5 * time.Second,
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		input       map[string]string
+		want        time.Duration
+	}{
+		{
+			description: "missing",
+			input:       map[string]string{"Content-Type": "application/json"},
+			want:        0,
+		},
+		{
+			description: "seconds",
+			input:       map[string]string{"Retry-After": "120"},
+			want:        2 * time.Minute,
+		},
+		{
+			description: "lower case",
+			input:       map[string]string{"retry-after": "5"},
+			want:        5 * time.Second,
+		},
+		{
+			description: "date",
+			input:       map[string]string{"Retry-After": "Sat, 17 Oct 2026 12:00:30 GMT"},
+			want:        30 * time.Second,
+		},
+		{
+			description: "date in the past",
+			input:       map[string]string{"Retry-After": "Sat, 17 Oct 2026 11:00:00 GMT"},
+			want:        0,
+		},
+		{
+			description: "invalid",
+			input:       map[string]string{"Retry-After": "soon"},
+			want:        0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := RetryAfter(test.input, now)
+			if got != test.want {
+				t.Errorf("got: %v want: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		input int
+		want  bool
+	}{
+		{input: -1, want: true},
+		{input: 400, want: false},
+		{input: 404, want: false},
+		{input: 408, want: true},
+		{input: 409, want: true},
+		{input: 429, want: true},
+		{input: 500, want: true},
+		{input: 503, want: true},
+	}
+
+	for _, test := range tests {
+		if got := Retryable(test.input); got != test.want {
+			t.Errorf("Retryable(%v) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
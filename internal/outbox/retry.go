@@ -0,0 +1,81 @@
+package outbox
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backoff computes the delay before each retry of a failed transmission. The
+// delay starts at Initial and doubles after every attempt, up to Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+
+	attempt int
+}
+
+// DefaultBackoff returns the Backoff used to retry event transmissions.
+func DefaultBackoff() *Backoff {
+	return &Backoff{Initial: time.Second, Max: 5 * time.Minute}
+}
+
+// Next returns the delay before the next attempt. A server-provided
+// retryAfter delay takes precedence over the exponential delay when it is
+// longer, but is capped at Max so that a server cannot stall retries
+// indefinitely.
+func (b *Backoff) Next(retryAfter time.Duration) time.Duration {
+	delay := b.Initial << b.attempt
+	if delay <= 0 || delay > b.Max {
+		delay = b.Max
+	} else {
+		b.attempt++
+	}
+
+	return max(delay, min(retryAfter, b.Max))
+}
+
+// Reset restarts the exponential delay from Initial.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// RetryAfter returns the delay requested by the server in the Retry-After
+// header of a response, given as either a number of seconds or an HTTP date.
+// It returns zero if the response has no valid Retry-After header.
+func RetryAfter(responseMetadata map[string]string, now time.Time) time.Duration {
+	var value string
+	for key, v := range responseMetadata {
+		if strings.EqualFold(key, "Retry-After") {
+			value = strings.TrimSpace(v)
+			break
+		}
+	}
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+
+	return 0
+}
+
+// Retryable reports whether a transmission that received responseCode should
+// be retried. Requests rejected by rate limiting (429) and server errors are
+// retried, as are requests rejected because the server lost track of the
+// events it acknowledged (409); other client errors are not, since resending
+// the same events would be rejected again. Negative codes indicate the
+// dispatcher could not send the request at all.
+func Retryable(responseCode int) bool {
+	return responseCode < 0 ||
+		responseCode == http.StatusConflict ||
+		responseCode == http.StatusTooManyRequests ||
+		responseCode == http.StatusRequestTimeout ||
+		responseCode >= http.StatusInternalServerError
+}
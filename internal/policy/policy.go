@@ -0,0 +1,473 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/goccy/go-yaml"
+)
+
+// builtinCollection is the collection that provides the modules referred to
+// by their short name, such as "shell".
+const builtinCollection = "ansible.builtin"
+
+// taskKeywords are the keys of a task that are not the name of the module the
+// task runs. Keys beginning with "with_" are loop keywords and are also
+// skipped.
+var taskKeywords = []string{
+	"action", "any_errors_fatal", "args", "async", "become", "become_exe",
+	"become_flags", "become_method", "become_user", "changed_when",
+	"check_mode", "collections", "connection", "debugger", "delay",
+	"delegate_facts", "delegate_to", "diff", "environment", "failed_when",
+	"ignore_errors", "ignore_unreachable", "listen", "local_action", "loop",
+	"loop_control", "module_defaults", "name", "no_log", "notify", "poll",
+	"port", "register", "remote_user", "retries", "run_once", "tags",
+	"throttle", "timeout", "until", "vars", "when",
+	"block", "rescue", "always",
+}
+
+// taskLists are the play keys holding lists of tasks.
+var taskLists = []string{"pre_tasks", "tasks", "post_tasks", "handlers"}
+
+// blockLists are the block keys holding lists of tasks.
+var blockLists = []string{"block", "rescue", "always"}
+
+// roleModules are the modules that run a role named by their "name" argument.
+var roleModules = []string{"ansible.builtin.include_role", "ansible.builtin.import_role"}
+
+// includeModules are the modules that run the tasks in a file.
+var includeModules = []string{
+	"ansible.builtin.include", "ansible.builtin.include_tasks", "ansible.builtin.import_tasks",
+}
+
+// setFactModule is the module that sets variables from within a play.
+const setFactModule = "ansible.builtin.set_fact"
+
+// Policy is a set of rules that a playbook must satisfy before it runs. The
+// zero value allows every playbook. For example:
+//
+//	denied-modules = ["ansible.builtin.shell", "ansible.builtin.command"]
+//	allowed-collections = ["ansible.builtin", "redhat.rhel_system_roles"]
+//	allowed-hosts = ["localhost"]
+//	deny-become = true
+type Policy struct {
+	// DeniedModules lists the modules that tasks may not run. Modules may be
+	// named by their fully qualified name or their short name. Tasks included
+	// from files and imported playbooks cannot be checked, so they are
+	// rejected whenever DeniedModules or AllowedCollections is set.
+	DeniedModules []string `toml:"denied-modules"`
+
+	// AllowedCollections lists the collections whose modules and roles a
+	// playbook may run. Modules named by their short name belong to
+	// ansible.builtin. Roles must be named by their fully qualified name, and
+	// tasks may not be included from files, since the tasks of roles outside a
+	// collection and of included files cannot be checked. An empty list allows
+	// every collection.
+	AllowedCollections []string `toml:"allowed-collections"`
+
+	// AllowedHosts lists the host patterns that plays may target. An empty
+	// list allows every host pattern.
+	AllowedHosts []string `toml:"allowed-hosts"`
+
+	// DenyBecome rejects plays, blocks, roles and tasks that may enable
+	// privilege escalation with "become", or by setting an "ansible_become"
+	// variable in "vars" or with set_fact. Any value other than a literal
+	// false, including a template, is taken to enable it.
+	DenyBecome bool `toml:"deny-become"`
+}
+
+// Violation describes a part of a playbook that does not satisfy a Policy.
+type Violation struct {
+	// Play identifies the offending play by its name, or its index if it has
+	// no name.
+	Play string
+
+	// Task identifies the offending task by its name, or its position within
+	// the play if it has no name. It is empty if the play itself is at fault.
+	Task string
+
+	// Reason describes the rule that is not satisfied.
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	if v.Task == "" {
+		return fmt.Sprintf("policy violation: play %v: %v", v.Play, v.Reason)
+	}
+	return fmt.Sprintf("policy violation: play %v: task %v: %v", v.Play, v.Task, v.Reason)
+}
+
+// Load reads the policy in the TOML file at path. If the file does not exist,
+// a policy allowing every playbook is returned.
+func Load(path string) (*Policy, error) {
+	var policy Policy
+	if _, err := toml.DecodeFile(path, &policy); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Policy{}, nil
+		}
+		return nil, fmt.Errorf("cannot read policy: path=%v err=%w", path, err)
+	}
+
+	for i, module := range policy.DeniedModules {
+		policy.DeniedModules[i] = qualifiedModule(module)
+	}
+
+	return &policy, nil
+}
+
+// Check parses the playbook in data and checks each play and task against the
+// policy, including the tasks nested in blocks. The first violation found is
+// returned as a *Violation.
+func (p *Policy) Check(data []byte) error {
+	var plays []map[string]any
+	if err := yaml.Unmarshal(data, &plays); err != nil {
+		return fmt.Errorf("cannot parse playbook: err=%w", err)
+	}
+
+	for i, play := range plays {
+		if err := p.checkPlay(i, play); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPlay checks the play at index i of the playbook.
+func (p *Policy) checkPlay(i int, play map[string]any) error {
+	playName := describe(play, fmt.Sprintf("#%v", i))
+	violation := func(task, reason string, args ...any) error {
+		return &Violation{Play: playName, Task: task, Reason: fmt.Sprintf(reason, args...)}
+	}
+
+	// A play may import another playbook in place of hosts and tasks. The
+	// imported playbook cannot be checked.
+	for _, key := range []string{"import_playbook", "ansible.builtin.import_playbook"} {
+		if _, has := play[key]; !has {
+			continue
+		}
+		if reason := p.checkModule(key); reason != "" {
+			return violation("", "%v", reason)
+		}
+		if p.restrictsModules() {
+			return violation("", "playbooks imported with %v cannot be checked against the module restrictions", key)
+		}
+	}
+
+	if len(p.AllowedHosts) > 0 {
+		for _, host := range hostPatterns(play["hosts"]) {
+			if !slices.Contains(p.AllowedHosts, host) {
+				return violation("", "hosts %v are not allowed", host)
+			}
+		}
+	}
+
+	if p.DenyBecome && becomes(play) {
+		return violation("", "privilege escalation with become is not allowed")
+	}
+
+	roles, _ := play["roles"].([]any)
+	for _, role := range roles {
+		if m, ok := role.(map[string]any); ok && p.DenyBecome && becomes(m) {
+			return violation("", "privilege escalation with become is not allowed")
+		}
+	}
+	for _, role := range roleNames(play["roles"]) {
+		if reason := p.checkRole(role); reason != "" {
+			return violation("", "%v", reason)
+		}
+	}
+
+	for _, key := range taskLists {
+		tasks, _ := play[key].([]any)
+		if err := p.checkTasks(key, tasks, violation); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkTasks checks a list of tasks, descending into blocks. path is the
+// location of the list within the play, used to identify unnamed tasks.
+func (p *Policy) checkTasks(
+	path string,
+	tasks []any,
+	violation func(task, reason string, args ...any) error,
+) error {
+	for i, item := range tasks {
+		task, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		taskPath := fmt.Sprintf("%v[%v]", path, i)
+		modules := taskModules(task)
+		taskName := describe(task, taskPath)
+		if _, has := task["name"]; !has && len(modules) == 1 {
+			taskName = fmt.Sprintf("%v (%v)", taskPath, modules[0])
+		}
+
+		// Ansible refuses to run a task naming more than one module, but
+		// which one is checked must not depend on the order of the keys.
+		if len(modules) > 1 {
+			return violation(taskName, "task runs more than one module: %v", strings.Join(modules, ", "))
+		}
+
+		if p.DenyBecome && becomes(task) {
+			return violation(taskName, "privilege escalation with become is not allowed")
+		}
+
+		if len(modules) == 1 {
+			module := modules[0]
+			if reason := p.checkModule(module); reason != "" {
+				return violation(taskName, "%v", reason)
+			}
+
+			qualified := qualifiedModule(module)
+			if slices.Contains(roleModules, qualified) {
+				if reason := p.checkRole(moduleArg(task, module, "name")); reason != "" {
+					return violation(taskName, "%v", reason)
+				}
+			}
+			if slices.Contains(includeModules, qualified) && p.restrictsModules() {
+				return violation(taskName, "tasks included with %v cannot be checked against the module restrictions", module)
+			}
+			if qualified == setFactModule && p.DenyBecome && setsBecome(moduleArgs(task, module)) {
+				return violation(taskName, "privilege escalation with become is not allowed")
+			}
+		}
+
+		for _, key := range blockLists {
+			nested, _ := task[key].([]any)
+			if err := p.checkTasks(taskPath+"."+key, nested, violation); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkModule returns the reason module may not be run, or an empty string if
+// it is allowed.
+func (p *Policy) checkModule(module string) string {
+	qualified := qualifiedModule(module)
+	if slices.Contains(p.DeniedModules, qualified) {
+		return fmt.Sprintf("module %v is denied", module)
+	}
+
+	if len(p.AllowedCollections) > 0 {
+		collection := qualified[:strings.LastIndex(qualified, ".")]
+		if !slices.Contains(p.AllowedCollections, collection) {
+			return fmt.Sprintf("module %v belongs to collection %v, which is not allowed", module, collection)
+		}
+	}
+
+	return ""
+}
+
+// restrictsModules reports whether the policy restricts the modules that
+// tasks may run.
+func (p *Policy) restrictsModules() bool {
+	return len(p.DeniedModules) > 0 || len(p.AllowedCollections) > 0
+}
+
+// checkRole returns the reason role may not be run, or an empty string if it
+// is allowed.
+func (p *Policy) checkRole(role string) string {
+	if len(p.AllowedCollections) == 0 {
+		return ""
+	}
+
+	// A role in a collection is named namespace.collection.role.
+	if strings.Count(role, ".") < 2 {
+		return fmt.Sprintf("role %v does not belong to a collection, so its tasks cannot be checked", role)
+	}
+	collection := role[:strings.LastIndex(role, ".")]
+	if !slices.Contains(p.AllowedCollections, collection) {
+		return fmt.Sprintf("role %v belongs to collection %v, which is not allowed", role, collection)
+	}
+
+	return ""
+}
+
+// taskModules returns the names of the modules run by task, sorted. A valid
+// task runs exactly one module, unless it is a block, which runs none.
+func taskModules(task map[string]any) []string {
+	var modules []string
+	for _, key := range []string{"action", "local_action"} {
+		switch v := task[key].(type) {
+		case string:
+			if fields := strings.Fields(v); len(fields) > 0 {
+				modules = append(modules, fields[0])
+			}
+		case map[string]any:
+			if module, ok := v["module"].(string); ok {
+				modules = append(modules, module)
+			}
+		}
+	}
+
+	for key := range task {
+		if slices.Contains(taskKeywords, key) || strings.HasPrefix(key, "with_") {
+			continue
+		}
+		modules = append(modules, key)
+	}
+
+	slices.Sort(modules)
+	return modules
+}
+
+// moduleArg returns the argument key passed to the module run by task, or an
+// empty string if it is not set.
+func moduleArg(task map[string]any, module string, key string) string {
+	if value, has := moduleArgs(task, module)[key]; has {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+// moduleArgs returns the arguments passed to the module run by task, whether
+// they are given as the value of the module's key, in the task's "args"
+// keyword or with "action" or "local_action". Arguments may be a mapping or
+// a string of key=value pairs.
+func moduleArgs(task map[string]any, module string) map[string]any {
+	args := map[string]any{}
+	add := func(value any) {
+		switch v := value.(type) {
+		case map[string]any:
+			for key, value := range v {
+				args[key] = value
+			}
+		case string:
+			for _, field := range strings.Fields(v) {
+				if key, value, found := strings.Cut(field, "="); found {
+					args[key] = value
+				}
+			}
+		}
+	}
+
+	add(task[module])
+	for _, key := range []string{"action", "local_action"} {
+		switch v := task[key].(type) {
+		case string:
+			add(v)
+		case map[string]any:
+			for key, value := range v {
+				if key != "module" {
+					args[key] = value
+				}
+			}
+		}
+	}
+	add(task["args"])
+	return args
+}
+
+// roleNames returns the names of the roles listed by the value of a play's
+// "roles" keyword. Each role is either a name or a mapping naming the role
+// with its "role" or "name" key.
+func roleNames(value any) []string {
+	roles, _ := value.([]any)
+	var names []string
+	for _, role := range roles {
+		switch v := role.(type) {
+		case string:
+			names = append(names, v)
+		case map[string]any:
+			for _, key := range []string{"role", "name"} {
+				if name, has := v[key]; has {
+					names = append(names, fmt.Sprint(name))
+					break
+				}
+			}
+		}
+	}
+	return names
+}
+
+// becomes reports whether a play, block, role or task may enable privilege
+// escalation, either with the "become" keyword or by setting an
+// "ansible_become" variable.
+func becomes(m map[string]any) bool {
+	if value, has := m["become"]; has && !isFalse(value) {
+		return true
+	}
+	vars, _ := m["vars"].(map[string]any)
+	return setsBecome(vars)
+}
+
+// setsBecome reports whether vars may enable privilege escalation by setting
+// an "ansible_become" variable, such as ansible_become or
+// ansible_become_user, to anything other than false.
+func setsBecome(vars map[string]any) bool {
+	for name, value := range vars {
+		if strings.HasPrefix(name, "ansible_become") && !isFalse(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// qualifiedModule returns the fully qualified name of module. Modules named by
+// their short name belong to ansible.builtin, and ansible.legacy modules are
+// treated as their ansible.builtin equivalent.
+func qualifiedModule(module string) string {
+	if short, found := strings.CutPrefix(module, "ansible.legacy."); found {
+		return builtinCollection + "." + short
+	}
+	if !strings.Contains(module, ".") {
+		return builtinCollection + "." + module
+	}
+	return module
+}
+
+// hostPatterns returns the host patterns targeted by the value of a play's
+// "hosts" keyword, which is either a comma separated string or a list.
+func hostPatterns(value any) []string {
+	var patterns []string
+	switch v := value.(type) {
+	case string:
+		for _, pattern := range strings.Split(v, ",") {
+			patterns = append(patterns, strings.TrimSpace(pattern))
+		}
+	case []any:
+		for _, pattern := range v {
+			patterns = append(patterns, fmt.Sprint(pattern))
+		}
+	}
+	return patterns
+}
+
+// describe returns the name of a play or task, or fallback if it has none.
+func describe(m map[string]any, fallback string) string {
+	if name, ok := m["name"].(string); ok && name != "" {
+		return fmt.Sprintf("%q", name)
+	}
+	return fallback
+}
+
+// isFalse reports whether value is literally false: a false boolean, one of
+// the YAML 1.1 boolean strings accepted by Ansible such as "no", or no value.
+// Templates are not false, since they are only evaluated when the playbook
+// runs.
+func isFalse(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "n", "no", "false", "off":
+			return true
+		}
+	}
+	return false
+}
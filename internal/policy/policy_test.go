@@ -0,0 +1,466 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.toml")
+	data := []byte(`denied-modules = ["shell", "ansible.legacy.command", "community.general.nmcli"]
+allowed-hosts = ["localhost"]
+deny-become = true
+`)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Policy{
+		DeniedModules: []string{
+			"ansible.builtin.shell",
+			"ansible.builtin.command",
+			"community.general.nmcli",
+		},
+		AllowedHosts: []string{"localhost"},
+		DenyBecome:   true,
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+
+	got, err = Load(filepath.Join(dir, "missing.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, &Policy{}) {
+		t.Errorf("missing policy file should allow every playbook: %#v", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		description string
+		policy      Policy
+		input       string
+		want        *Violation
+	}{
+		{
+			description: "empty policy",
+			policy:      Policy{},
+			input: `- hosts: all
+  become: true
+  tasks:
+    - ansible.builtin.shell: rm -rf /tmp/scratch
+`,
+		},
+		{
+			description: "denied module",
+			policy:      Policy{DeniedModules: []string{"ansible.builtin.shell"}},
+			input: `- name: cleanup
+  hosts: localhost
+  tasks:
+    - name: list files
+      ansible.builtin.find:
+        paths: /tmp
+    - name: remove scratch
+      shell: rm -rf /tmp/scratch
+`,
+			want: &Violation{
+				Play:   `"cleanup"`,
+				Task:   `"remove scratch"`,
+				Reason: "module shell is denied",
+			},
+		},
+		{
+			description: "denied module in rescue",
+			policy:      Policy{DeniedModules: []string{"ansible.builtin.command"}},
+			input: `- hosts: localhost
+  tasks:
+    - block:
+        - ansible.builtin.ping:
+      rescue:
+        - ansible.legacy.command: /usr/bin/true
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   "tasks[0].rescue[0] (ansible.legacy.command)",
+				Reason: "module ansible.legacy.command is denied",
+			},
+		},
+		{
+			description: "denied module in handler action",
+			policy:      Policy{DeniedModules: []string{"ansible.builtin.command"}},
+			input: `- hosts: localhost
+  handlers:
+    - name: restart
+      action: command systemctl restart httpd
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"restart"`,
+				Reason: "module command is denied",
+			},
+		},
+		{
+			description: "allowed collections",
+			policy:      Policy{AllowedCollections: []string{"ansible.builtin"}},
+			input: `- hosts: localhost
+  pre_tasks:
+    - ping:
+  post_tasks:
+    - name: configure network
+      community.general.nmcli:
+        conn_name: eth0
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"configure network"`,
+				Reason: "module community.general.nmcli belongs to collection community.general, which is not allowed",
+			},
+		},
+		{
+			description: "more than one module",
+			policy:      Policy{DeniedModules: []string{"ansible.builtin.shell"}},
+			input: `- hosts: localhost
+  tasks:
+    - name: ambiguous
+      ansible.builtin.ping:
+      shell: rm -rf /tmp/scratch
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"ambiguous"`,
+				Reason: "task runs more than one module: ansible.builtin.ping, shell",
+			},
+		},
+		{
+			description: "role outside the allowed collections",
+			policy:      Policy{AllowedCollections: []string{"ansible.builtin", "redhat.rhel_system_roles"}},
+			input: `- hosts: localhost
+  roles:
+    - redhat.rhel_system_roles.timesync
+    - role: community.general.dummy
+      vars:
+        name: value
+`,
+			want: &Violation{
+				Play:   "#0",
+				Reason: "role community.general.dummy belongs to collection community.general, which is not allowed",
+			},
+		},
+		{
+			description: "role outside a collection",
+			policy:      Policy{AllowedCollections: []string{"ansible.builtin"}},
+			input: `- hosts: localhost
+  roles:
+    - name: webserver
+`,
+			want: &Violation{
+				Play:   "#0",
+				Reason: "role webserver does not belong to a collection, so its tasks cannot be checked",
+			},
+		},
+		{
+			description: "included role outside the allowed collections",
+			policy:      Policy{AllowedCollections: []string{"ansible.builtin"}},
+			input: `- hosts: localhost
+  tasks:
+    - name: configure
+      include_role:
+        name: community.general.dummy
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"configure"`,
+				Reason: "role community.general.dummy belongs to collection community.general, which is not allowed",
+			},
+		},
+		{
+			description: "imported role outside the allowed collections",
+			policy:      Policy{AllowedCollections: []string{"ansible.builtin"}},
+			input: `- hosts: localhost
+  tasks:
+    - ansible.builtin.import_role:
+      args:
+        name: community.general.dummy
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   "tasks[0] (ansible.builtin.import_role)",
+				Reason: "role community.general.dummy belongs to collection community.general, which is not allowed",
+			},
+		},
+		{
+			description: "included tasks",
+			policy:      Policy{AllowedCollections: []string{"ansible.builtin"}},
+			input: `- hosts: localhost
+  tasks:
+    - include_tasks: other.yml
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   "tasks[0] (include_tasks)",
+				Reason: "tasks included with include_tasks cannot be checked against the module restrictions",
+			},
+		},
+		{
+			description: "imported tasks",
+			policy:      Policy{AllowedCollections: []string{"ansible.builtin"}},
+			input: `- hosts: localhost
+  handlers:
+    - name: restart
+      ansible.builtin.import_tasks: restart.yml
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"restart"`,
+				Reason: "tasks included with ansible.builtin.import_tasks cannot be checked against the module restrictions",
+			},
+		},
+		{
+			description: "included tasks with denied modules",
+			policy:      Policy{DeniedModules: []string{"ansible.builtin.shell"}},
+			input: `- hosts: localhost
+  tasks:
+    - name: run other tasks
+      ansible.builtin.include_tasks: /tmp/other.yml
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"run other tasks"`,
+				Reason: "tasks included with ansible.builtin.include_tasks cannot be checked against the module restrictions",
+			},
+		},
+		{
+			description: "imported playbook with denied modules",
+			policy:      Policy{DeniedModules: []string{"ansible.builtin.shell"}},
+			input: `- hosts: localhost
+  tasks: []
+- import_playbook: /tmp/other.yml
+`,
+			want: &Violation{
+				Play:   "#1",
+				Reason: "playbooks imported with import_playbook cannot be checked against the module restrictions",
+			},
+		},
+		{
+			description: "included tasks without module restrictions",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  tasks:
+    - include_tasks: other.yml
+- import_playbook: other.yml
+`,
+		},
+		{
+			description: "allowed roles and included roles",
+			policy:      Policy{AllowedCollections: []string{"ansible.builtin", "redhat.rhel_system_roles"}},
+			input: `- hosts: localhost
+  roles:
+    - redhat.rhel_system_roles.timesync
+  tasks:
+    - include_role:
+        name: redhat.rhel_system_roles.selinux
+`,
+		},
+		{
+			description: "allowed hosts",
+			policy:      Policy{AllowedHosts: []string{"localhost"}},
+			input: `- hosts: localhost
+  tasks: []
+- hosts: localhost,webservers
+  tasks: []
+`,
+			want: &Violation{
+				Play:   "#1",
+				Reason: "hosts webservers are not allowed",
+			},
+		},
+		{
+			description: "become on play",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  become: yes
+  tasks: []
+`,
+			want: &Violation{
+				Play:   "#0",
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+		{
+			description: "become variable on play",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  vars:
+    ansible_become: true
+  tasks: []
+`,
+			want: &Violation{
+				Play:   "#0",
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+		{
+			description: "become variable on task",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  tasks:
+    - name: install
+      vars:
+        ansible_become: "yes"
+      ansible.builtin.dnf:
+        name: httpd
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"install"`,
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+		{
+			description: "templated become on play",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  become: "{{ true }}"
+  tasks: []
+`,
+			want: &Violation{
+				Play:   "#0",
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+		{
+			description: "templated become on task",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  tasks:
+    - name: install
+      become: "{{ 1 == 1 }}"
+      ansible.builtin.dnf:
+        name: httpd
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"install"`,
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+		{
+			description: "become user variable on play",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  vars:
+    ansible_become_user: root
+  tasks: []
+`,
+			want: &Violation{
+				Play:   "#0",
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+		{
+			description: "become variable set with set_fact",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  tasks:
+    - name: escalate
+      set_fact:
+        ansible_become: true
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"escalate"`,
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+		{
+			description: "become variable set with set_fact action",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  tasks:
+    - action: ansible.builtin.set_fact ansible_become=yes
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   "tasks[0] (ansible.builtin.set_fact)",
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+		{
+			description: "become on role",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  roles:
+    - role: redhat.rhel_system_roles.timesync
+      become: true
+`,
+			want: &Violation{
+				Play:   "#0",
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+		{
+			description: "become disabled",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  become: no
+  vars:
+    ansible_become: false
+  tasks:
+    - become: "False"
+      set_fact:
+        ansible_become: off
+        other: "{{ true }}"
+`,
+		},
+		{
+			description: "become on nested task",
+			policy:      Policy{DenyBecome: true},
+			input: `- hosts: localhost
+  become: false
+  tasks:
+    - block:
+        - block:
+            - name: install
+              become: true
+              ansible.builtin.dnf:
+                name: httpd
+`,
+			want: &Violation{
+				Play:   "#0",
+				Task:   `"install"`,
+				Reason: "privilege escalation with become is not allowed",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := test.policy.Check([]byte(test.input))
+			if test.want == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var got *Violation
+			if !errors.As(err, &got) {
+				t.Fatalf("expected a violation, got: %v", err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
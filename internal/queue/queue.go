@@ -0,0 +1,216 @@
+package queue
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrQueueFull is returned by Enqueue when the queue already holds the maximum
+// number of waiting messages.
+var ErrQueueFull = errors.New("run queue is full")
+
+// Message is a dispatched message waiting to be run. It carries everything
+// needed to process the message again should the worker restart before the
+// message reaches the head of the queue.
+type Message struct {
+	Seq        uint64            `json:"seq"`
+	Addr       string            `json:"addr"`
+	ID         string            `json:"id"`
+	ResponseTo string            `json:"response_to"`
+	Metadata   map[string]string `json:"metadata"`
+	Data       []byte            `json:"data"`
+}
+
+// entry is a message held in the queue.
+type entry struct {
+	msg Message
+
+	// ready is closed when the entry reaches the head of the queue.
+	ready chan struct{}
+
+	// claimed is false for entries restored from disk that have not yet been
+	// picked up again by a call to Enqueue.
+	claimed bool
+}
+
+// Queue is a bounded FIFO queue of messages. The message at the head of the
+// queue is the one allowed to run; every other message waits for the messages
+// ahead of it to be removed. Each queued message is persisted as a file in the
+// queue directory until it is removed.
+type Queue struct {
+	dir     string
+	depth   int
+	lock    sync.Mutex
+	entries []*entry
+	nextSeq uint64
+
+	// interrupted is the message that was at the head of the queue, and so
+	// running, when the previous instance exited.
+	interrupted *Message
+}
+
+// New creates a Queue that persists messages in dir and holds at most depth
+// messages waiting behind the message at its head. Messages persisted in dir
+// by a previous instance are restored in their original order, ahead of any
+// message enqueued later. The message that was at the head of the queue is not
+// restored, since its playbook may have been partially applied; it is returned
+// by Interrupted instead. A negative depth is rejected.
+func New(dir string, depth int) (*Queue, error) {
+	if depth < 0 {
+		return nil, fmt.Errorf("invalid queue depth: depth must not be negative: depth=%v", depth)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create queue directory: directory=%v err=%w", dir, err)
+	}
+
+	q := &Queue{
+		dir:   dir,
+		depth: depth,
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read queue directory: directory=%v err=%w", dir, err)
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read queued message: path=%v err=%w", path, err)
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			slog.Warn("discarding invalid queued message:", "path", path, "err", err)
+			_ = os.Remove(path)
+			continue
+		}
+		q.entries = append(q.entries, &entry{msg: msg, ready: make(chan struct{})})
+		q.nextSeq = max(q.nextSeq, msg.Seq+1)
+	}
+	slices.SortFunc(q.entries, func(a, b *entry) int {
+		return cmp.Compare(a.msg.Seq, b.msg.Seq)
+	})
+	if len(q.entries) > 0 {
+		q.interrupted = &q.entries[0].msg
+		q.entries = q.entries[1:]
+	}
+	if len(q.entries) > 0 {
+		close(q.entries[0].ready)
+	}
+
+	return q, nil
+}
+
+// Interrupted returns the message that was running when the previous instance
+// exited, if there was one and it has not yet been removed. It remains
+// persisted until it is removed, but never runs again.
+func (q *Queue) Interrupted() (Message, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.interrupted == nil {
+		return Message{}, false
+	}
+	return *q.interrupted, true
+}
+
+// Restored returns the messages restored from disk that have not yet been
+// claimed by a call to Enqueue, in queue order.
+func (q *Queue) Restored() []Message {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var messages []Message
+	for _, e := range q.entries {
+		if !e.claimed {
+			messages = append(messages, e.msg)
+		}
+	}
+	return messages
+}
+
+// Enqueue adds msg to the tail of the queue. It returns the number of messages
+// ahead of msg and a channel that is closed once msg reaches the head of the
+// queue. If msg was restored from disk, its existing place in the queue is
+// claimed instead. ErrQueueFull is returned if there is no room left in the
+// queue.
+func (q *Queue) Enqueue(msg Message) (int, <-chan struct{}, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i, e := range q.entries {
+		if e.msg.ID == msg.ID && !e.claimed {
+			e.claimed = true
+			return i, e.ready, nil
+		}
+	}
+
+	if len(q.entries) > q.depth {
+		return 0, nil, ErrQueueFull
+	}
+
+	msg.Seq = q.nextSeq
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0, nil, fmt.Errorf("cannot marshal message: err=%w", err)
+	}
+	if err := os.WriteFile(q.path(msg), data, 0600); err != nil {
+		return 0, nil, fmt.Errorf("cannot write queued message: path=%v err=%w", q.path(msg), err)
+	}
+	q.nextSeq++
+
+	e := &entry{msg: msg, ready: make(chan struct{}), claimed: true}
+	if len(q.entries) == 0 {
+		close(e.ready)
+	}
+	q.entries = append(q.entries, e)
+
+	return len(q.entries) - 1, e.ready, nil
+}
+
+// Remove removes the message identified by id from the queue, whether it is
+// at the head of the queue, still waiting or interrupted. If the head of the
+// queue is removed, the next message is signaled that it may run.
+func (q *Queue) Remove(id string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.interrupted != nil && q.interrupted.ID == id {
+		if err := os.Remove(q.path(*q.interrupted)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("cannot remove queued message:", "id", id, "err", err)
+		}
+		q.interrupted = nil
+		return
+	}
+
+	i := slices.IndexFunc(q.entries, func(e *entry) bool { return e.msg.ID == id })
+	if i < 0 {
+		return
+	}
+
+	if err := os.Remove(q.path(q.entries[i].msg)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("cannot remove queued message:", "id", id, "err", err)
+	}
+
+	q.entries = slices.Delete(q.entries, i, i+1)
+	if i == 0 && len(q.entries) > 0 {
+		close(q.entries[0].ready)
+	}
+}
+
+// path returns the file path msg is persisted to.
+func (q *Queue) path(msg Message) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.json", msg.Seq))
+}
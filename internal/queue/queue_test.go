@@ -0,0 +1,162 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// isReady reports whether the channel returned by Enqueue has been closed.
+func isReady(ready <-chan struct{}) bool {
+	select {
+	case <-ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	q, err := New(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	position, first, err := q.Enqueue(Message{ID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 0 || !isReady(first) {
+		t.Errorf("first message should run immediately: position=%v ready=%v", position, isReady(first))
+	}
+
+	position, second, err := q.Enqueue(Message{ID: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 1 || isReady(second) {
+		t.Errorf("second message should wait: position=%v ready=%v", position, isReady(second))
+	}
+
+	_, _, err = q.Enqueue(Message{ID: "c"})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("got: %v want: %v", err, ErrQueueFull)
+	}
+
+	q.Remove("a")
+	if !isReady(second) {
+		t.Error("second message should run after the first is removed")
+	}
+}
+
+func TestNewNegativeDepth(t *testing.T) {
+	if _, err := New(t.TempDir(), -1); err == nil {
+		t.Error("expected error")
+	}
+
+	// A depth of zero lets a message run but none wait.
+	q, err := New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ready, err := q.Enqueue(Message{ID: "a"}); err != nil || !isReady(ready) {
+		t.Errorf("first message should run immediately: err=%v", err)
+	}
+	if _, _, err := q.Enqueue(Message{ID: "b"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("got: %v want: %v", err, ErrQueueFull)
+	}
+}
+
+func TestRemoveWaiting(t *testing.T) {
+	q, err := New(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _ = q.Enqueue(Message{ID: "a"})
+	_, _, _ = q.Enqueue(Message{ID: "b"})
+	_, third, _ := q.Enqueue(Message{ID: "c"})
+
+	q.Remove("b")
+	if isReady(third) {
+		t.Error("removing a waiting message should not release the queue")
+	}
+
+	q.Remove("a")
+	if !isReady(third) {
+		t.Error("third message should run after the first is removed")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := New(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if _, _, err := q.Enqueue(Message{
+			ID:       id,
+			Metadata: map[string]string{"return_url": "https://example.com"},
+			Data:     []byte(id),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Remove("a")
+
+	restored, err := New(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The message at the head of the queue was running, so it is reported as
+	// interrupted rather than restored.
+	wantInterrupted := Message{Seq: 1, ID: "b", Metadata: map[string]string{"return_url": "https://example.com"}, Data: []byte("b")}
+	if got, has := restored.Interrupted(); !has || !cmp.Equal(got, wantInterrupted) {
+		t.Errorf("interrupted message mismatch (-got +want):\n%v", cmp.Diff(got, wantInterrupted))
+	}
+	want := []Message{
+		{Seq: 2, ID: "c", Metadata: map[string]string{"return_url": "https://example.com"}, Data: []byte("c")},
+		{Seq: 3, ID: "d", Metadata: map[string]string{"return_url": "https://example.com"}, Data: []byte("d")},
+	}
+	if got := restored.Restored(); !cmp.Equal(got, want) {
+		t.Errorf("restored messages mismatch (-got +want):\n%v", cmp.Diff(got, want))
+	}
+
+	// A new message is queued behind the restored messages.
+	position, _, err := restored.Enqueue(Message{ID: "e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 2 {
+		t.Errorf("got: %v want: %v", position, 2)
+	}
+
+	// Claiming a restored message keeps its place in the queue.
+	position, ready, err := restored.Enqueue(Message{ID: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 0 || !isReady(ready) {
+		t.Errorf("restored message should be at the head: position=%v ready=%v", position, isReady(ready))
+	}
+	if got := restored.Restored(); len(got) != 1 || got[0].ID != "d" {
+		t.Errorf("unexpected unclaimed messages: %v", got)
+	}
+
+	// Removing the interrupted message removes it from disk.
+	restored.Remove("b")
+	if _, has := restored.Interrupted(); has {
+		t.Error("interrupted message should be removed")
+	}
+	reopened, err := New(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, has := reopened.Interrupted(); !has || got.ID != "c" {
+		t.Errorf("got interrupted message %v, want c", got.ID)
+	}
+}
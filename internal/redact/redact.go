@@ -0,0 +1,148 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Mask replaces redacted data.
+const Mask = "********"
+
+// noLogMessage replaces the stdout of events produced by tasks with no_log
+// enabled.
+const noLogMessage = "the output has been hidden due to the fact that 'no_log: true' was specified for this result"
+
+// DefaultPatterns match commonly leaked secrets: passwords and tokens assigned
+// to a variable, bearer tokens and PEM encoded private keys.
+var DefaultPatterns = []string{
+	`(?i)(?:password|passwd|secret|token|api[_-]?key)["']?\s*[:=]\s*["']?([^\s"',]+)`,
+	`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`,
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+}
+
+// Redactor masks sensitive data in job events before they are transmitted.
+type Redactor struct {
+	rules []*regexp.Regexp
+}
+
+// New creates a Redactor applying the regular expressions in patterns. If a
+// pattern has capture groups, only the text they match is masked. Otherwise,
+// the entire match is masked.
+func New(patterns []string) (*Redactor, error) {
+	rules := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		rule, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile redaction pattern: pattern=%v err=%w", pattern, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return &Redactor{rules: rules}, nil
+}
+
+// Event redacts the job event in place and returns the number of redactions
+// made. The stdout of events whose result was produced with no_log enabled is
+// replaced entirely. Every string in the event is then masked according to
+// the Redactor's rules.
+func (r *Redactor) Event(event map[string]any) int {
+	count := 0
+	if noLog(event) {
+		if stdout, ok := event["stdout"].(string); ok && stdout != "" {
+			event["stdout"] = noLogMessage
+			count++
+		}
+	}
+
+	for key, value := range event {
+		var n int
+		event[key], n = r.value(value)
+		count += n
+	}
+
+	return count
+}
+
+// value redacts value, descending into maps and lists, and returns the
+// redacted value along with the number of redactions made.
+func (r *Redactor) value(value any) (any, int) {
+	switch v := value.(type) {
+	case string:
+		return r.String(v)
+	case map[string]any:
+		count := 0
+		for key, item := range v {
+			var n int
+			v[key], n = r.value(item)
+			count += n
+		}
+		return v, count
+	case []any:
+		count := 0
+		for i, item := range v {
+			var n int
+			v[i], n = r.value(item)
+			count += n
+		}
+		return v, count
+	default:
+		return value, 0
+	}
+}
+
+// String masks s according to the Redactor's rules and returns the masked
+// string along with the number of redactions made.
+func (r *Redactor) String(s string) (string, int) {
+	count := 0
+	for _, rule := range r.rules {
+		matches := rule.FindAllStringSubmatchIndex(s, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		var b strings.Builder
+		last := 0
+		for _, match := range matches {
+			// Mask the capture groups if the rule has any, otherwise the
+			// entire match.
+			spans := [][2]int{{match[0], match[1]}}
+			if len(match) > 2 {
+				spans = spans[:0]
+				for i := 2; i+1 < len(match); i += 2 {
+					if match[i] >= 0 && match[i+1] > match[i] {
+						spans = append(spans, [2]int{match[i], match[i+1]})
+					}
+				}
+			}
+			for _, span := range spans {
+				if span[0] < last || s[span[0]:span[1]] == Mask {
+					continue
+				}
+				b.WriteString(s[last:span[0]])
+				b.WriteString(Mask)
+				last = span[1]
+				count++
+			}
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+
+	return s, count
+}
+
+// noLog reports whether event holds a task result produced with no_log
+// enabled.
+func noLog(event map[string]any) bool {
+	eventData, ok := event["event_data"].(map[string]any)
+	if !ok {
+		return false
+	}
+	res, ok := eventData["res"].(map[string]any)
+	if !ok {
+		return false
+	}
+	censored, _ := res["_ansible_no_log"].(bool)
+	return censored
+}
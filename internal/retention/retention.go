@@ -0,0 +1,237 @@
+// Package retention removes the files left by past playbook runs.
+package retention
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockSuffix is the extension of the file locked while a run is in progress.
+const lockSuffix = ".lock"
+
+// Policy decides which past runs are kept. A zero limit leaves that limit
+// unset.
+type Policy struct {
+	// MaxAge is the longest a run is kept after it was last written to.
+	MaxAge time.Duration
+
+	// MaxRuns is the number of most recent runs kept.
+	MaxRuns int
+
+	// MaxBytes is the total size of the files of the most recent runs kept.
+	MaxBytes int64
+
+	// KeepFailedOnly removes every run that succeeded, keeping only those
+	// that did not.
+	KeepFailedOnly bool
+}
+
+// Enabled reports whether the policy removes any run.
+func (p Policy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxRuns > 0 || p.MaxBytes > 0 || p.KeepFailedOnly
+}
+
+// Run is a past playbook run and the files it left.
+type Run struct {
+	// ID is the correlation ID of the run.
+	ID string
+
+	// Time is when the run's files were last written to.
+	Time time.Time
+
+	// Failed is true unless ansible-runner reported the run successful.
+	Failed bool
+
+	// Bytes is the total size of the run's files.
+	Bytes int64
+
+	// Paths are the files and directories left by the run.
+	Paths []string
+}
+
+// Expired returns the runs that the policy removes at time now. Runs are
+// considered from the most recent; a run is kept only while the runs kept
+// before it leave room for it within every limit.
+func (p Policy) Expired(runs []Run, now time.Time) []Run {
+	runs = slices.Clone(runs)
+	slices.SortFunc(runs, func(a, b Run) int {
+		return cmp.Or(b.Time.Compare(a.Time), cmp.Compare(a.ID, b.ID))
+	})
+
+	var expired []Run
+	var keptRuns int
+	var keptBytes int64
+	for _, run := range runs {
+		switch {
+		case p.KeepFailedOnly && !run.Failed,
+			p.MaxAge > 0 && now.Sub(run.Time) > p.MaxAge,
+			p.MaxRuns > 0 && keptRuns >= p.MaxRuns,
+			p.MaxBytes > 0 && keptBytes+run.Bytes > p.MaxBytes:
+			expired = append(expired, run)
+		default:
+			keptRuns++
+			keptBytes += run.Bytes
+		}
+	}
+
+	return expired
+}
+
+// Collect returns the runs whose ansible-runner artifacts are in artifactsDir
+// or whose playbook was written to playbookDir. A run is identified by the
+// name of its artifacts directory, and its playbook is named after it with a
+// ".yaml" extension. Runs whose ID is in exclude are left out, as are runs
+// locked by Lock in any process.
+func Collect(artifactsDir string, playbookDir string, exclude []string) ([]Run, error) {
+	runs := map[string]*Run{}
+	run := func(id string) *Run {
+		if runs[id] == nil {
+			runs[id] = &Run{ID: id, Failed: true}
+		}
+		return runs[id]
+	}
+
+	artifacts, err := os.ReadDir(artifactsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("cannot read artifacts directory: directory=%v err=%w", artifactsDir, err)
+	}
+	for _, entry := range artifacts {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(artifactsDir, entry.Name())
+		modified, size, err := usage(path)
+		if err != nil {
+			return nil, err
+		}
+		r := run(entry.Name())
+		r.Paths = append(r.Paths, path)
+		r.Time = later(r.Time, modified)
+		r.Bytes += size
+		if status, err := os.ReadFile(filepath.Join(path, "status")); err == nil {
+			r.Failed = strings.TrimSpace(string(status)) != "successful"
+		}
+	}
+
+	playbooks, err := os.ReadDir(playbookDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("cannot read playbook directory: directory=%v err=%w", playbookDir, err)
+	}
+	for _, entry := range playbooks {
+		// The lock file left by a process that exited during a run belongs to
+		// the run, like its playbook.
+		id, isPlaybook := strings.CutSuffix(entry.Name(), ".yaml")
+		if !isPlaybook {
+			id, isPlaybook = strings.CutSuffix(entry.Name(), lockSuffix)
+		}
+		if entry.IsDir() || !isPlaybook {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("cannot stat file: path=%v err=%w", entry.Name(), err)
+		}
+		r := run(id)
+		r.Paths = append(r.Paths, filepath.Join(playbookDir, entry.Name()))
+		r.Time = later(r.Time, info.ModTime())
+		r.Bytes += info.Size()
+	}
+
+	collected := make([]Run, 0, len(runs))
+	for id, r := range runs {
+		if slices.Contains(exclude, id) || locked(playbookDir, id) {
+			continue
+		}
+		collected = append(collected, *r)
+	}
+	return collected, nil
+}
+
+// Lock marks the run identified by id as in progress, so that Collect leaves
+// it out in every process until unlock is called. dir is the directory the
+// run's playbook is written to.
+func Lock(dir string, id string) (unlock func() error, err error) {
+	path := filepath.Join(dir, id+lockSuffix)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create lock file: path=%v err=%w", path, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("cannot lock file: path=%v err=%w", path, err)
+	}
+
+	return func() error {
+		// Remove the file before releasing the lock, so that a lock file that
+		// is not locked was left by a process that exited during its run.
+		err := os.Remove(path)
+		if err != nil {
+			err = fmt.Errorf("cannot remove lock file: path=%v err=%w", path, err)
+		}
+		return errors.Join(err, file.Close())
+	}, nil
+}
+
+// locked reports whether the run identified by id is locked by Lock in dir.
+func locked(dir string, id string) bool {
+	file, err := os.Open(filepath.Join(dir, id+lockSuffix))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	return errors.Is(err, syscall.EWOULDBLOCK)
+}
+
+// Remove removes the files left by run.
+func Remove(run Run) error {
+	var errs []error
+	for _, path := range run.Paths {
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, fmt.Errorf("cannot remove run files: path=%v err=%w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// usage returns the latest modification time and the total size of the files
+// in the directory tree rooted at dir.
+func usage(dir string) (time.Time, int64, error) {
+	var modified time.Time
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		modified = later(modified, info.ModTime())
+		if !d.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("cannot read run files: directory=%v err=%w", dir, err)
+	}
+	return modified, size, nil
+}
+
+// later returns the later of a and b.
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
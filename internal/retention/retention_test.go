@@ -0,0 +1,192 @@
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPolicyExpired(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	runs := []Run{
+		{ID: "a", Time: now.Add(-1 * time.Hour), Bytes: 100},
+		{ID: "b", Time: now.Add(-2 * time.Hour), Bytes: 100, Failed: true},
+		{ID: "c", Time: now.Add(-48 * time.Hour), Bytes: 100},
+		{ID: "d", Time: now.Add(-72 * time.Hour), Bytes: 100, Failed: true},
+	}
+
+	tests := []struct {
+		description string
+		input       Policy
+		want        []string
+	}{
+		{
+			description: "disabled",
+			input:       Policy{},
+			want:        nil,
+		},
+		{
+			description: "max age",
+			input:       Policy{MaxAge: 24 * time.Hour},
+			want:        []string{"c", "d"},
+		},
+		{
+			description: "max runs",
+			input:       Policy{MaxRuns: 1},
+			want:        []string{"b", "c", "d"},
+		},
+		{
+			description: "max bytes",
+			input:       Policy{MaxBytes: 250},
+			want:        []string{"c", "d"},
+		},
+		{
+			description: "keep failed only",
+			input:       Policy{KeepFailedOnly: true},
+			want:        []string{"a", "c"},
+		},
+		{
+			description: "keep failed only with max runs",
+			input:       Policy{KeepFailedOnly: true, MaxRuns: 1},
+			want:        []string{"a", "c", "d"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var got []string
+			for _, run := range test.input.Expired(runs, now) {
+				got = append(got, run.ID)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("\ngot:\n%v\nwant:\n%v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCollect(t *testing.T) {
+	artifactsDir := filepath.Join(t.TempDir(), "artifacts")
+	playbookDir := t.TempDir()
+
+	files := map[string]string{
+		filepath.Join(artifactsDir, "passed", "status"):                  "successful",
+		filepath.Join(artifactsDir, "passed", "job_events", "1-a.json"):  "{}",
+		filepath.Join(artifactsDir, "failed", "status"):                  "failed",
+		filepath.Join(artifactsDir, "running", "job_events", "1-b.json"): "{}",
+		filepath.Join(playbookDir, "passed.yaml"):                        "- hosts: localhost\n",
+		filepath.Join(playbookDir, "orphan.yaml"):                        "- hosts: localhost\n",
+		filepath.Join(playbookDir, "events.jsonl"):                       "{}\n",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs, err := Collect(artifactsDir, playbookDir, []string{"running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(runs, func(a, b Run) int { return strings.Compare(a.ID, b.ID) })
+
+	type summary struct {
+		ID     string
+		Failed bool
+		Bytes  int64
+		Paths  []string
+	}
+	var got []summary
+	for _, run := range runs {
+		if run.Time.IsZero() {
+			t.Errorf("run %v has no modification time", run.ID)
+		}
+		got = append(got, summary{run.ID, run.Failed, run.Bytes, run.Paths})
+	}
+	want := []summary{
+		{"failed", true, 6, []string{filepath.Join(artifactsDir, "failed")}},
+		{"orphan", true, 19, []string{filepath.Join(playbookDir, "orphan.yaml")}},
+		{"passed", false, 31, []string{
+			filepath.Join(artifactsDir, "passed"),
+			filepath.Join(playbookDir, "passed.yaml"),
+		}},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("\ngot:\n%v\nwant:\n%v", got, want)
+	}
+
+	if err := Remove(runs[2]); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range runs[2].Paths {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%v was not removed: err=%v", path, err)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	artifactsDir := filepath.Join(t.TempDir(), "artifacts")
+	playbookDir := t.TempDir()
+
+	files := map[string]string{
+		filepath.Join(artifactsDir, "running", "status"): "running",
+		filepath.Join(playbookDir, "running.yaml"):       "- hosts: localhost\n",
+		filepath.Join(playbookDir, "crashed.yaml"):       "- hosts: localhost\n",
+		filepath.Join(playbookDir, "crashed.lock"):       "",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unlock, err := Lock(playbookDir, "running")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The locked run is left out, and the lock file left by a crashed run is
+	// removed with it.
+	runs, err := Collect(artifactsDir, playbookDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, run := range runs {
+		got = append(got, run.Paths)
+	}
+	want := [][]string{{
+		filepath.Join(playbookDir, "crashed.lock"),
+		filepath.Join(playbookDir, "crashed.yaml"),
+	}}
+	if !cmp.Equal(got, want) {
+		t.Errorf("\ngot:\n%v\nwant:\n%v", got, want)
+	}
+
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(playbookDir, "running.lock")); !os.IsNotExist(err) {
+		t.Errorf("lock file was not removed: err=%v", err)
+	}
+
+	runs, err = Collect(artifactsDir, playbookDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Errorf("got %v runs, want 2 once the run is unlocked", len(runs))
+	}
+}
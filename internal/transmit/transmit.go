@@ -0,0 +1,177 @@
+// Package transmit sends the data produced by playbook runs to their
+// destination.
+package transmit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil/worker"
+)
+
+// A Transmitter sends data to addr, typically a URL, on behalf of the message
+// identified by responseTo. The metadata holds the headers describing the
+// data. The response code and metadata follow the conventions of HTTP; a
+// negative code means no response was received.
+type Transmitter interface {
+	Transmit(
+		addr string,
+		id string,
+		responseTo string,
+		metadata map[string]string,
+		data []byte,
+	) (responseCode int, responseMetadata map[string]string, responseData []byte, err error)
+}
+
+// The yggdrasil worker transmits data through the dispatcher's D-Bus
+// com.redhat.Yggdrasil1.Dispatcher1.Transmit method.
+var _ Transmitter = (*worker.Worker)(nil)
+
+// File is a Transmitter that appends the data it is given to a file instead
+// of sending it. The parts of multipart data are decompressed and written one
+// after the other, so that a file receiving job events holds one event per
+// line.
+type File struct {
+	path string
+	lock sync.Mutex
+}
+
+// NewFile returns a File appending data to the file at path.
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// Transmit appends data to the file, responding as a server accepting the
+// upload.
+func (f *File) Transmit(
+	addr string,
+	id string,
+	responseTo string,
+	metadata map[string]string,
+	data []byte,
+) (int, map[string]string, []byte, error) {
+	content, err := unpack(metadata["Content-Type"], data)
+	if err != nil {
+		return -1, nil, nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return -1, nil, nil, fmt.Errorf("cannot create directory: directory=%v err=%w", filepath.Dir(f.path), err)
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return -1, nil, nil, fmt.Errorf("cannot open file: path=%v err=%w", f.path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(content); err != nil {
+		return -1, nil, nil, fmt.Errorf("cannot write file: path=%v err=%w", f.path, err)
+	}
+
+	return http.StatusAccepted, map[string]string{}, nil, nil
+}
+
+// unpack returns the content of data, whose media type is contentType. The
+// parts of multipart data are concatenated, decompressing those with a "gzip"
+// Content-Encoding. The content always ends with a newline.
+func unpack(contentType string, data []byte) ([]byte, error) {
+	content := data
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		content = nil
+		reader := multipart.NewReader(bytes.NewReader(data), params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("cannot read multipart data: err=%w", err)
+			}
+
+			var partReader io.Reader = part
+			if part.Header.Get("Content-Encoding") == "gzip" {
+				gz, err := gzip.NewReader(part)
+				if err != nil {
+					return nil, fmt.Errorf("cannot decompress part: err=%w", err)
+				}
+				partReader = gz
+			}
+			partContent, err := io.ReadAll(partReader)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read part: err=%w", err)
+			}
+			content = append(content, partContent...)
+		}
+	}
+
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	return content, nil
+}
+
+// HTTP is a Transmitter that POSTs data to a fixed URL, such as a collector
+// on the local network, instead of the address it is given.
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTP returns an HTTP transmitter posting data to url.
+func NewHTTP(url string) *HTTP {
+	return &HTTP{
+		url:    url,
+		client: &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Transmit POSTs data to the transmitter's URL, sending metadata as request
+// headers. The response headers are returned as the response metadata, under
+// their canonical names.
+func (h *HTTP) Transmit(
+	addr string,
+	id string,
+	responseTo string,
+	metadata map[string]string,
+	data []byte,
+) (int, map[string]string, []byte, error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(data))
+	if err != nil {
+		return -1, nil, nil, fmt.Errorf("cannot create request: err=%w", err)
+	}
+	for name, value := range metadata {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return -1, nil, nil, fmt.Errorf("cannot send request: err=%w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return -1, nil, nil, fmt.Errorf("cannot read response body: err=%w", err)
+	}
+
+	responseMetadata := map[string]string{}
+	for name := range resp.Header {
+		responseMetadata[name] = resp.Header.Get(name)
+	}
+
+	return resp.StatusCode, responseMetadata, body, nil
+}
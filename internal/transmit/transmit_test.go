@@ -0,0 +1,142 @@
+package transmit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// multipartBody returns a multipart body holding content in a single part,
+// gzip compressed if compress is true, and its Content-Type.
+func multipartBody(t *testing.T, content string, compress bool) ([]byte, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "application/vnd.redhat.playbook.v1+jsonl")
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+	}
+	part, err := writer.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compress {
+		gz := gzip.NewWriter(part)
+		if _, err := io.WriteString(gz, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	} else if _, err := io.WriteString(part, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.Bytes(), writer.FormDataContentType()
+}
+
+func TestFileTransmit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events", "events.jsonl")
+	f := NewFile(path)
+
+	plain, plainType := multipartBody(t, "{\"counter\":1}\n{\"counter\":2}\n", false)
+	compressed, compressedType := multipartBody(t, "{\"counter\":3}\n", true)
+	transmissions := []struct {
+		contentType string
+		data        []byte
+	}{
+		{plainType, plain},
+		{compressedType, compressed},
+		{"application/json", []byte(`{"counter":4}`)},
+	}
+	for _, transmission := range transmissions {
+		code, _, _, err := f.Transmit(
+			"https://example.com",
+			"id",
+			"responseTo",
+			map[string]string{"Content-Type": transmission.contentType},
+			transmission.data,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusAccepted {
+			t.Errorf("got %v, want %v", code, http.StatusAccepted)
+		}
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"counter\":1}\n{\"counter\":2}\n{\"counter\":3}\n{\"counter\":4}\n"
+	if string(got) != want {
+		t.Errorf("\ngot:\n%v\nwant:\n%v", string(got), want)
+	}
+}
+
+func TestHTTPTransmit(t *testing.T) {
+	var gotContentType string
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("got %v, want %v", r.Method, http.MethodPost)
+		}
+		gotContentType = r.Header.Get("Content-Type")
+		gotBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte("slow down"))
+	}))
+	defer server.Close()
+
+	h := NewHTTP(server.URL)
+	code, metadata, body, err := h.Transmit(
+		"https://example.com",
+		"id",
+		"responseTo",
+		map[string]string{"Content-Type": "text/plain"},
+		[]byte("data"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotContentType != "text/plain" {
+		t.Errorf("got %v, want %v", gotContentType, "text/plain")
+	}
+	if string(gotBody) != "data" {
+		t.Errorf("got %v, want %v", string(gotBody), "data")
+	}
+	if code != http.StatusTooManyRequests {
+		t.Errorf("got %v, want %v", code, http.StatusTooManyRequests)
+	}
+	if metadata["Retry-After"] != "30" {
+		t.Errorf("got %v, want %v", metadata["Retry-After"], "30")
+	}
+	if string(body) != "slow down" {
+		t.Errorf("got %v, want %v", string(body), "slow down")
+	}
+}
+
+func TestHTTPTransmitUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	code, _, _, err := NewHTTP(server.URL).Transmit("", "", "", nil, nil)
+	if err == nil {
+		t.Error("expected error")
+	}
+	if code != -1 {
+		t.Errorf("got %v, want %v", code, -1)
+	}
+}
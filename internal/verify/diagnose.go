@@ -0,0 +1,102 @@
+package verify
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// PlayReport describes the verification of a single play, so that playbook
+// authors can find out why a signature does not verify.
+type PlayReport struct {
+	// Index is the position of the play in the playbook.
+	Index int
+
+	// Name is the name of the play, if it has one.
+	Name string
+
+	// Exclusions are the paths listed in the play's
+	// insights_signature_exclude variable.
+	Exclusions []string
+
+	// KeyID is the ID of the key that made the signature, as recorded in the
+	// signature, in upper case hexadecimal. It is set even if the key is not
+	// in the keyring.
+	KeyID string
+
+	// Fingerprint is the fingerprint of the trusted key that verified the
+	// signature. It is empty if the play failed verification.
+	Fingerprint string
+
+	// Signed is the canonical serialization of the play, with the excluded
+	// paths removed, whose digest is signed.
+	Signed string
+
+	// Err is the reason the play failed verification, or nil if it passed.
+	Err error
+}
+
+// Diagnose checks the signature of every play in the playbook, like Verify,
+// and reports the details of the verification of each play. Unlike Verify, it
+// does not stop at the first play that fails. An error is returned only if the
+// playbook cannot be parsed.
+func (v *Verifier) Diagnose(data []byte) ([]PlayReport, error) {
+	plays, err := loadPlaybook(data)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]PlayReport, 0, len(plays))
+	for i, play := range plays {
+		report := PlayReport{Index: i}
+		if name, has := play.get("name"); has {
+			report.Name = fmt.Sprint(name)
+		}
+
+		if exclusions, err := playExclusions(play); err == nil {
+			report.Exclusions = exclusions
+		}
+		if signature, err := playSignature(play); err == nil {
+			report.KeyID, _ = signatureKeyID(signature)
+		}
+		if signed, err := excludePaths(play); err == nil {
+			report.Signed = serialize(signed)
+		}
+
+		signer, err := v.verifyPlay(play)
+		if err != nil {
+			report.Err = err
+		} else {
+			report.Fingerprint = Fingerprint(signer)
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// signatureKeyID returns the ID of the key that made the ASCII armored
+// signature.
+func signatureKeyID(signature []byte) (string, error) {
+	block, err := armor.Decode(bytes.NewReader(signature))
+	if err != nil {
+		return "", fmt.Errorf("cannot decode signature: %w", err)
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		return "", fmt.Errorf("cannot read signature: %w", err)
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		return "", fmt.Errorf("cannot read signature: unexpected packet %T", p)
+	}
+	if sig.IssuerKeyId == nil {
+		return "", fmt.Errorf("cannot read signature: missing issuer key ID")
+	}
+
+	return strings.ToUpper(fmt.Sprintf("%016x", *sig.IssuerKeyId)), nil
+}
@@ -0,0 +1,159 @@
+package verify
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// serialize renders value the way Python's repr() renders the equivalent
+// Python value. Playbook signatures are computed over the repr() of each play,
+// so the output must match it exactly.
+func serialize(value any) string {
+	var b strings.Builder
+	writeValue(&b, value)
+	return b.String()
+}
+
+// writeValue writes the Python representation of value to b.
+func writeValue(b *strings.Builder, value any) {
+	switch v := value.(type) {
+	case nil:
+		b.WriteString("None")
+	case bool:
+		if v {
+			b.WriteString("True")
+		} else {
+			b.WriteString("False")
+		}
+	case *big.Int:
+		b.WriteString(v.String())
+	case float64:
+		b.WriteString(formatFloat(v))
+	case string:
+		writeString(b, v)
+	case []byte:
+		writeBytes(b, v)
+	case pyDate:
+		fmt.Fprintf(b, "datetime.date(%d, %d, %d)", v.year, v.month, v.day)
+	case []any:
+		b.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeValue(b, item)
+		}
+		b.WriteByte(']')
+	case orderedMap:
+		b.WriteByte('{')
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeValue(b, item.Key)
+			b.WriteString(": ")
+			writeValue(b, item.Value)
+		}
+		b.WriteByte('}')
+	default:
+		fmt.Fprintf(b, "%v", v)
+	}
+}
+
+// formatFloat formats f the way Python's float.__repr__ does: the shortest
+// representation that round-trips, in positional notation for exponents from
+// -4 up to 16 and in scientific notation otherwise.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+
+	exponent := 0
+	if f != 0 {
+		scientific := strconv.FormatFloat(f, 'e', -1, 64)
+		exponent, _ = strconv.Atoi(scientific[strings.IndexByte(scientific, 'e')+1:])
+	}
+	if exponent < -4 || exponent >= 16 {
+		return strconv.FormatFloat(f, 'e', -1, 64)
+	}
+
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// writeString writes the Python representation of a str to b.
+func writeString(b *strings.Builder, s string) {
+	quote := '\''
+	if strings.ContainsRune(s, '\'') && !strings.ContainsRune(s, '"') {
+		quote = '"'
+	}
+
+	b.WriteRune(quote)
+	for _, r := range s {
+		switch {
+		case r == quote || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < ' ' || r == 0x7f:
+			fmt.Fprintf(b, `\x%02x`, r)
+		case r < 0x7f:
+			b.WriteRune(r)
+		case unicode.IsPrint(r):
+			b.WriteRune(r)
+		case r <= 0xff:
+			fmt.Fprintf(b, `\x%02x`, r)
+		case r <= 0xffff:
+			fmt.Fprintf(b, `\u%04x`, r)
+		default:
+			fmt.Fprintf(b, `\U%08x`, r)
+		}
+	}
+	b.WriteRune(quote)
+}
+
+// writeBytes writes the Python representation of a bytes object to b.
+func writeBytes(b *strings.Builder, data []byte) {
+	quote := byte('\'')
+	if strings.ContainsRune(string(data), '\'') && !strings.ContainsRune(string(data), '"') {
+		quote = '"'
+	}
+
+	b.WriteByte('b')
+	b.WriteByte(quote)
+	for _, c := range data {
+		switch {
+		case c == quote || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte(quote)
+}
@@ -0,0 +1,103 @@
+package verify
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// trustPolicyFile is the name of the optional file in a keyring directory
+// that restricts when the keys in the keyring are trusted.
+const trustPolicyFile = "trust.toml"
+
+// keyPolicy restricts the period during which a key is trusted. A zero time
+// leaves that end of the period open.
+type keyPolicy struct {
+	NotBefore time.Time `toml:"not-before"`
+	NotAfter  time.Time `toml:"not-after"`
+}
+
+// trustPolicy is the trust policy of a keyring. For example:
+//
+//	revoked = ["0123456789ABCDEF0123456789ABCDEF01234567"]
+//
+//	[keys.89ABCDEF0123456789ABCDEF0123456789ABCDEF]
+//	not-before = 2025-01-01T00:00:00Z
+//	not-after = 2027-01-01T00:00:00Z
+type trustPolicy struct {
+	// Revoked lists the fingerprints of keys that are no longer trusted.
+	Revoked []string `toml:"revoked"`
+
+	// Keys maps key fingerprints to the period during which they are trusted.
+	// Keys not listed are trusted indefinitely.
+	Keys map[string]keyPolicy `toml:"keys"`
+}
+
+// loadTrustPolicy reads the trust policy of the keyring in keyringDir. An
+// empty policy is returned if the keyring has no trust policy file.
+func loadTrustPolicy(keyringDir string) (*trustPolicy, error) {
+	path := filepath.Join(keyringDir, trustPolicyFile)
+
+	var policy trustPolicy
+	if _, err := toml.DecodeFile(path, &policy); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &trustPolicy{}, nil
+		}
+		return nil, fmt.Errorf("cannot read trust policy: path=%v err=%w", path, err)
+	}
+
+	// Normalize fingerprints so that they can be written in any case and
+	// with or without spaces.
+	for i, fingerprint := range policy.Revoked {
+		policy.Revoked[i] = normalizeFingerprint(fingerprint)
+	}
+	keys := make(map[string]keyPolicy, len(policy.Keys))
+	for fingerprint, key := range policy.Keys {
+		keys[normalizeFingerprint(fingerprint)] = key
+	}
+	policy.Keys = keys
+
+	return &policy, nil
+}
+
+// check returns an error if signer is not trusted at time now.
+func (p *trustPolicy) check(signer *openpgp.Entity, now time.Time) error {
+	fingerprint := Fingerprint(signer)
+
+	if slices.Contains(p.Revoked, fingerprint) {
+		return fmt.Errorf("key %v is revoked", fingerprint)
+	}
+
+	key, has := p.Keys[fingerprint]
+	if !has {
+		return nil
+	}
+	if !key.NotBefore.IsZero() && now.Before(key.NotBefore) {
+		return fmt.Errorf("key %v is not valid before %v", fingerprint, key.NotBefore)
+	}
+	if !key.NotAfter.IsZero() && now.After(key.NotAfter) {
+		return fmt.Errorf("key %v expired on %v", fingerprint, key.NotAfter)
+	}
+
+	return nil
+}
+
+// Fingerprint returns the fingerprint of entity's primary key as an upper case
+// hexadecimal string.
+func Fingerprint(entity *openpgp.Entity) string {
+	return strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint))
+}
+
+// normalizeFingerprint converts fingerprint to the format returned by
+// Fingerprint.
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+}
@@ -0,0 +1,262 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const (
+	// signatureVar is the play variable holding the play's signature.
+	signatureVar = "insights_signature"
+
+	// exclusionsVar is the play variable listing the paths excluded from the
+	// play's signature.
+	exclusionsVar = "insights_signature_exclude"
+)
+
+// excludableVars are the top-level play keys that may be excluded from a
+// signature, either entirely or one of their entries.
+var excludableVars = []string{"hosts", "vars"}
+
+// keyFileExtensions are the extensions of the files read from a keyring
+// directory.
+var keyFileExtensions = []string{".asc", ".gpg", ".pub"}
+
+// Verifier verifies the insights_signature of each play in a playbook against
+// a keyring of trusted public keys.
+type Verifier struct {
+	keyring openpgp.EntityList
+	policy  *trustPolicy
+
+	// now returns the time at which key validity is evaluated.
+	now func() time.Time
+}
+
+// NewVerifier creates a Verifier trusting every public key found in the files
+// in keyringDir. Keys may be ASCII armored or binary. Trust in individual keys
+// may be further restricted by a trust.toml file in keyringDir, which lists
+// revoked keys and the validity period of keys.
+func NewVerifier(keyringDir string) (*Verifier, error) {
+	files, err := os.ReadDir(keyringDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read keyring directory: directory=%v err=%w", keyringDir, err)
+	}
+
+	var keyring openpgp.EntityList
+	for _, file := range files {
+		if file.IsDir() || !slices.Contains(keyFileExtensions, filepath.Ext(file.Name())) {
+			continue
+		}
+		path := filepath.Join(keyringDir, file.Name())
+		entities, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("loaded public keys:", "path", path, "count", len(entities))
+		keyring = append(keyring, entities...)
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("cannot load keyring: no public keys found in %v", keyringDir)
+	}
+
+	policy, err := loadTrustPolicy(keyringDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Verifier{keyring: keyring, policy: policy, now: time.Now}, nil
+}
+
+// readKeyFile reads the public keys in the file at path.
+func readKeyFile(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: path=%v err=%w", path, err)
+	}
+
+	var entities openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key file: path=%v err=%w", path, err)
+	}
+
+	return entities, nil
+}
+
+// Verify checks the signature of every play in the playbook. It returns the
+// fingerprints of the keys that signed the plays, without duplicates, or an
+// error identifying the first play that fails verification.
+func (v *Verifier) Verify(data []byte) ([]string, error) {
+	plays, err := loadPlaybook(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var fingerprints []string
+	for i, play := range plays {
+		signer, err := v.verifyPlay(play)
+		if err != nil {
+			name, _ := play.get("name")
+			return nil, fmt.Errorf("cannot verify play %v (%v): %w", i, name, err)
+		}
+		if fingerprint := Fingerprint(signer); !slices.Contains(fingerprints, fingerprint) {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+
+	return fingerprints, nil
+}
+
+// verifyPlay checks the signature of a single play and returns the key that
+// signed it. The signature is a detached OpenPGP signature over the SHA-256
+// digest of the serialized play, with the paths listed in
+// insights_signature_exclude removed. The signing key must be trusted by the
+// keyring's trust policy.
+func (v *Verifier) verifyPlay(play orderedMap) (*openpgp.Entity, error) {
+	signature, err := playSignature(play)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := excludePaths(play)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(serialize(signed)))
+	signer, err := openpgp.CheckArmoredDetachedSignature(
+		v.keyring,
+		bytes.NewReader(digest[:]),
+		bytes.NewReader(signature),
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	if err := v.policy.check(signer, v.now()); err != nil {
+		return nil, fmt.Errorf("untrusted signature: %w", err)
+	}
+
+	return signer, nil
+}
+
+// playSignature returns the ASCII armored signature of play. The signature is
+// stored base64 encoded in the binary insights_signature variable.
+func playSignature(play orderedMap) ([]byte, error) {
+	vars, err := playVars(play)
+	if err != nil {
+		return nil, err
+	}
+	value, has := vars.get(signatureVar)
+	if !has {
+		return nil, fmt.Errorf("missing variable: %v", signatureVar)
+	}
+
+	var encoded []byte
+	switch v := value.(type) {
+	case []byte:
+		encoded = v
+	case string:
+		encoded = []byte(v)
+	default:
+		return nil, fmt.Errorf("invalid variable: %v is not a binary value", signatureVar)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(encoded), nil)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %v: %w", signatureVar, err)
+	}
+
+	return signature, nil
+}
+
+// excludePaths returns a copy of play with the paths listed in its
+// insights_signature_exclude variable removed. Each path is either a
+// top-level key ("/hosts") or an entry of a top-level mapping
+// ("/vars/insights_signature"), and only "hosts" and "vars" may be excluded.
+func excludePaths(play orderedMap) (orderedMap, error) {
+	exclusions, err := playExclusions(play)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := playVars(play)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the play and its vars, the only nested mapping that may be
+	// modified.
+	signed := append(orderedMap{}, play...)
+	signed.set("vars", append(orderedMap{}, vars...))
+
+	for _, exclusion := range exclusions {
+		var path []string
+		for _, element := range strings.Split(exclusion, "/") {
+			if element != "" {
+				path = append(path, element)
+			}
+		}
+
+		switch {
+		case len(path) == 1 && slices.Contains(excludableVars, path[0]) && signed.delete(path[0]):
+		case len(path) == 2 && slices.Contains(excludableVars, path[0]):
+			value, _ := signed.get(path[0])
+			parent, ok := value.(orderedMap)
+			if !ok || !parent.delete(path[1]) {
+				return nil, fmt.Errorf("invalid field: the variable %v does not exist", exclusion)
+			}
+			signed.set(path[0], parent)
+		default:
+			return nil, fmt.Errorf("invalid exclusion: the variable %v is not a valid exclusion", exclusion)
+		}
+	}
+
+	return signed, nil
+}
+
+// playExclusions returns the paths listed in the insights_signature_exclude
+// variable of play.
+func playExclusions(play orderedMap) ([]string, error) {
+	vars, err := playVars(play)
+	if err != nil {
+		return nil, err
+	}
+	value, has := vars.get(exclusionsVar)
+	if !has {
+		return nil, fmt.Errorf("missing variable: %v", exclusionsVar)
+	}
+	exclusions, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid variable: %v is not a string", exclusionsVar)
+	}
+	return strings.Split(exclusions, ","), nil
+}
+
+// playVars returns the vars mapping of play.
+func playVars(play orderedMap) (orderedMap, error) {
+	value, has := play.get("vars")
+	if !has {
+		return nil, errors.New("missing play keyword: vars")
+	}
+	vars, ok := value.(orderedMap)
+	if !ok {
+		return nil, errors.New("invalid play keyword: vars is not a mapping")
+	}
+	return vars, nil
+}
@@ -0,0 +1,418 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+func readFile(t *testing.T, file string) []byte {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("cannot read file %v: %v", file, err)
+	}
+	return data
+}
+
+// unsignedPlay is a play template; the signature is appended to its vars.
+const unsignedPlay = `- name: Update packages
+  hosts: localhost
+  become: yes
+  vars:
+    package: httpd
+    insights_signature_exclude: /hosts,/vars/insights_signature
+  tasks:
+    - name: Update {{ package }}
+      ansible.builtin.dnf:
+        name: "{{ package }}"
+        state: latest
+        mode: 0644
+`
+
+// newKeyring generates a signing key and writes its public key to a keyring
+// directory.
+func newKeyring(t *testing.T) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("rhc-worker-playbook test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.asc"), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return entity, dir
+}
+
+// signPlaybook signs the single play in playbook with signer, returning the
+// playbook with the insights_signature variable added.
+func signPlaybook(t *testing.T, signer *openpgp.Entity, playbook string) []byte {
+	plays, err := loadPlaybook([]byte(playbook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := playVars(plays[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars.set(signatureVar, []byte{})
+	plays[0].set("vars", vars)
+	signed, err := excludePaths(plays[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(serialize(signed)))
+
+	signature := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(signature, signer, bytes.NewReader(digest[:]), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(
+		[]byte(base64.StdEncoding.EncodeToString(signature.Bytes())),
+	)
+	insertAt := strings.Index(playbook, "  tasks:")
+	return []byte(playbook[:insertAt] +
+		"    insights_signature: !!binary |\n      " + encoded + "\n" +
+		playbook[insertAt:])
+}
+
+func TestSerialize(t *testing.T) {
+	plays, err := loadPlaybook(readFile(t, "../../testdata/insights_remove.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := excludePaths(plays[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{'name': 'Insights Disable', 'become': True, 'vars': {'insights_signature_exclude': '/hosts,/vars/insights_signature'}, 'tasks': [{'name': 'Disable the insights-client', 'command': 'insights-client --disable-schedule'}]}`
+	if got := serialize(signed); got != want {
+		t.Errorf("\ngot:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestSerializeYAML11Scalars(t *testing.T) {
+	plays, err := loadPlaybook([]byte(`- values: [yes, No, 0755, 0x1f, 1:30, 1.5, 1e3, .inf, ~, 2001-12-14, 'it''s', "x\ty", 1_000, 3.0e+20, 0.00001, "é"]
+  base: &base {a: 1}
+  merged:
+    <<: *base
+    b: 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{'values': [True, False, 493, 31, 90, 1.5, '1e3', inf, None, datetime.date(2001, 12, 14), "it's", 'x\ty', 1000, 3e+20, 1e-05, 'é'], 'base': {'a': 1}, 'merged': {'a': 1, 'b': 2}}`
+	if got := serialize(plays[0]); got != want {
+		t.Errorf("\ngot:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	signer, keyringDir := newKeyring(t)
+	_, otherKeyringDir := newKeyring(t)
+	playbook := signPlaybook(t, signer, unsignedPlay)
+
+	tests := []struct {
+		description string
+		keyringDir  string
+		playbook    []byte
+		wantError   string
+	}{
+		{
+			description: "valid signature",
+			keyringDir:  keyringDir,
+			playbook:    playbook,
+		},
+		{
+			description: "excluded hosts may change",
+			keyringDir:  keyringDir,
+			playbook:    bytes.Replace(playbook, []byte("hosts: localhost"), []byte("hosts: all"), 1),
+		},
+		{
+			description: "modified task",
+			keyringDir:  keyringDir,
+			playbook:    bytes.Replace(playbook, []byte("state: latest"), []byte("state: absent"), 1),
+			wantError:   "invalid signature",
+		},
+		{
+			description: "unknown signing key",
+			keyringDir:  otherKeyringDir,
+			playbook:    playbook,
+			wantError:   "invalid signature",
+		},
+		{
+			description: "invalid exclusion",
+			keyringDir:  keyringDir,
+			playbook:    bytes.Replace(playbook, []byte("/hosts,"), []byte("/tasks,"), 1),
+			wantError:   "invalid exclusion",
+		},
+		{
+			description: "missing signature",
+			keyringDir:  keyringDir,
+			playbook:    []byte(unsignedPlay),
+			wantError:   "missing variable: insights_signature",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			verifier, err := NewVerifier(test.keyringDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fingerprints, err := verifier.Verify(test.playbook)
+			if test.wantError == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if len(fingerprints) != 1 || fingerprints[0] != Fingerprint(signer) {
+					t.Errorf("got: %v want: %v", fingerprints, []string{Fingerprint(signer)})
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantError) {
+				t.Errorf("got: %v want error containing: %v", err, test.wantError)
+			}
+		})
+	}
+}
+
+// TestVerifySignedFixtures verifies playbooks signed with gpg the same way as
+// Red Hat signs playbooks. testdata/insights_remove_test_key.yml is signed with
+// the test key in testdata/keyring; testdata/insights_remove.yml is signed
+// with the Red Hat key, which is not in that keyring.
+func TestVerifySignedFixtures(t *testing.T) {
+	testKeyPlaybook := readFile(t, "../../testdata/insights_remove_test_key.yml")
+
+	tests := []struct {
+		description string
+		playbook    []byte
+		wantKeyID   string
+		wantError   string
+	}{
+		{
+			description: "signed with the test key",
+			playbook:    testKeyPlaybook,
+		},
+		{
+			description: "excluded hosts changed after signing",
+			playbook:    bytes.Replace(testKeyPlaybook, []byte("hosts: localhost"), []byte("hosts: all"), 1),
+		},
+		{
+			description: "task changed after signing",
+			playbook: bytes.Replace(
+				testKeyPlaybook,
+				[]byte("insights-client --disable-schedule"),
+				[]byte("insights-client --unregister"),
+				1,
+			),
+			wantError: "invalid signature",
+		},
+		{
+			description: "signed with the Red Hat key",
+			playbook:    readFile(t, "../../testdata/insights_remove.yml"),
+			wantKeyID:   "CBF0E7C0FE8F9A4D",
+			wantError:   "invalid signature",
+		},
+	}
+
+	verifier, err := NewVerifier("../../testdata/keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifier.keyring) != 1 {
+		t.Fatalf("got %v keys, want 1", len(verifier.keyring))
+	}
+	testKey := Fingerprint(verifier.keyring[0])
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			fingerprints, err := verifier.Verify(test.playbook)
+			if test.wantError == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if !slices.Equal(fingerprints, []string{testKey}) {
+					t.Errorf("got: %v want: %v", fingerprints, []string{testKey})
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.wantError) {
+				t.Errorf("got: %v want error containing: %v", err, test.wantError)
+			}
+
+			if test.wantKeyID == "" {
+				return
+			}
+			reports, err := verifier.Diagnose(test.playbook)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reports) != 1 || reports[0].KeyID != test.wantKeyID {
+				t.Errorf("got: %v want key ID: %v", reports, test.wantKeyID)
+			}
+		})
+	}
+}
+
+func TestNewVerifierEmptyKeyring(t *testing.T) {
+	if _, err := NewVerifier(t.TempDir()); err == nil {
+		t.Error("expected an error for an empty keyring directory")
+	}
+}
+
+func TestVerifyTrustPolicy(t *testing.T) {
+	signer, keyringDir := newKeyring(t)
+	playbook := signPlaybook(t, signer, unsignedPlay)
+	fingerprint := Fingerprint(signer)
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		policy      string
+		wantError   string
+	}{
+		{
+			description: "key within its validity period",
+			policy: "[keys." + fingerprint + "]\n" +
+				"not-before = 2026-01-01T00:00:00Z\n" +
+				"not-after = 2027-01-01T00:00:00Z\n",
+		},
+		{
+			description: "key not yet valid",
+			policy: "[keys." + fingerprint + "]\n" +
+				"not-before = 2026-07-01T00:00:00Z\n",
+			wantError: "is not valid before",
+		},
+		{
+			description: "expired key",
+			policy: "[keys." + strings.ToLower(fingerprint) + "]\n" +
+				"not-after = 2026-01-01T00:00:00Z\n",
+			wantError: "expired",
+		},
+		{
+			description: "revoked key",
+			policy:      "revoked = [\"" + fingerprint + "\"]\n",
+			wantError:   "is revoked",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := os.WriteFile(filepath.Join(keyringDir, trustPolicyFile), []byte(test.policy), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier, err := NewVerifier(keyringDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier.now = func() time.Time { return now }
+
+			_, err = verifier.Verify(playbook)
+			if test.wantError == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantError) {
+				t.Errorf("got: %v want error containing: %v", err, test.wantError)
+			}
+		})
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	signer, keyringDir := newKeyring(t)
+	playbook := signPlaybook(t, signer, unsignedPlay)
+	tampered := bytes.Replace(playbook, []byte("state: latest"), []byte("state: absent"), 1)
+	keyID := strings.ToUpper(fmt.Sprintf("%016x", signer.PrimaryKey.KeyId))
+
+	verifier, err := NewVerifier(keyringDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description     string
+		playbook        []byte
+		wantFingerprint string
+		wantError       string
+	}{
+		{
+			description:     "valid signature",
+			playbook:        playbook,
+			wantFingerprint: Fingerprint(signer),
+		},
+		{
+			description: "modified task",
+			playbook:    tampered,
+			wantError:   "invalid signature",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			reports, err := verifier.Diagnose(test.playbook)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reports) != 1 {
+				t.Fatalf("got %v reports, want 1", len(reports))
+			}
+			report := reports[0]
+
+			if report.Name != "Update packages" {
+				t.Errorf("got: %v want: %v", report.Name, "Update packages")
+			}
+			wantExclusions := []string{"/hosts", "/vars/insights_signature"}
+			if !slices.Equal(report.Exclusions, wantExclusions) {
+				t.Errorf("got: %v want: %v", report.Exclusions, wantExclusions)
+			}
+			if report.KeyID != keyID {
+				t.Errorf("got: %v want: %v", report.KeyID, keyID)
+			}
+			if report.Fingerprint != test.wantFingerprint {
+				t.Errorf("got: %v want: %v", report.Fingerprint, test.wantFingerprint)
+			}
+			if strings.Contains(report.Signed, "localhost") || !strings.Contains(report.Signed, "'name': 'Update packages'") {
+				t.Errorf("unexpected signed content: %v", report.Signed)
+			}
+			if test.wantError == "" {
+				if report.Err != nil {
+					t.Errorf("unexpected error: %v", report.Err)
+				}
+				return
+			}
+			if report.Err == nil || !strings.Contains(report.Err.Error(), test.wantError) {
+				t.Errorf("got: %v want error containing: %v", report.Err, test.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package verify
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+	"github.com/goccy/go-yaml/token"
+)
+
+// The playbook signature is computed over the plays as loaded by PyYAML's
+// SafeLoader, which follows YAML 1.1. Plain scalars are therefore resolved
+// using the YAML 1.1 rules implemented by PyYAML rather than the YAML 1.2
+// rules of the YAML library, so that "yes", "0755" and "1:30" load as the same
+// values they were signed as.
+var (
+	yaml11Bool = regexp.MustCompile(
+		`^(?:yes|Yes|YES|no|No|NO|true|True|TRUE|false|False|FALSE|on|On|ON|off|Off|OFF)$`,
+	)
+	yaml11Int = regexp.MustCompile(
+		`^(?:[-+]?0b[0-1_]+|[-+]?0[0-7_]+|[-+]?(?:0|[1-9][0-9_]*)|[-+]?0x[0-9a-fA-F_]+|[-+]?[1-9][0-9_]*(?::[0-5]?[0-9])+)$`,
+	)
+	yaml11Float = regexp.MustCompile(
+		`^(?:[-+]?(?:[0-9][0-9_]*)\.[0-9_]*(?:[eE][-+][0-9]+)?|\.[0-9][0-9_]*(?:[eE][-+][0-9]+)?|[-+]?[0-9][0-9_]*(?::[0-5]?[0-9])+\.[0-9_]*|[-+]?\.(?:inf|Inf|INF)|\.(?:nan|NaN|NAN))$`,
+	)
+	yaml11Null      = regexp.MustCompile(`^(?:~|null|Null|NULL|)$`)
+	yaml11Date      = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+	yaml11Timestamp = regexp.MustCompile(`^[0-9]{4}-[0-9]{1,2}-[0-9]{1,2}(?:[Tt]|[ \t]+)`)
+)
+
+// mapItem is a single key/value pair of a mapping.
+type mapItem struct {
+	Key   any
+	Value any
+}
+
+// orderedMap is a mapping that preserves the order of its keys, mirroring the
+// insertion order of a Python dict.
+type orderedMap []mapItem
+
+// get returns the value of key and whether key is present.
+func (m orderedMap) get(key any) (any, bool) {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// set sets the value of key, keeping the position of an existing key.
+func (m *orderedMap) set(key, value any) {
+	for i, item := range *m {
+		if item.Key == key {
+			(*m)[i].Value = value
+			return
+		}
+	}
+	*m = append(*m, mapItem{Key: key, Value: value})
+}
+
+// delete removes key, reporting whether it was present.
+func (m *orderedMap) delete(key any) bool {
+	for i, item := range *m {
+		if item.Key == key {
+			*m = append((*m)[:i], (*m)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pyDate is a YAML 1.1 date, loaded by PyYAML as a datetime.date.
+type pyDate struct {
+	year, month, day int
+}
+
+// loadPlaybook parses data and returns its plays, each as an orderedMap.
+func loadPlaybook(data []byte) ([]orderedMap, error) {
+	file, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse playbook: %w", err)
+	}
+	if len(file.Docs) == 0 || file.Docs[0].Body == nil {
+		return nil, fmt.Errorf("cannot load playbook: playbook is empty")
+	}
+
+	l := loader{anchors: map[string]any{}}
+	value, err := l.load(file.Docs[0].Body)
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("cannot load playbook: playbook is not a list of plays")
+	}
+	plays := make([]orderedMap, 0, len(list))
+	for i, item := range list {
+		play, ok := item.(orderedMap)
+		if !ok {
+			return nil, fmt.Errorf("cannot load playbook: play %v is not a mapping", i)
+		}
+		plays = append(plays, play)
+	}
+
+	return plays, nil
+}
+
+// loader converts a YAML syntax tree into Go values equivalent to the Python
+// values PyYAML's SafeLoader would construct.
+type loader struct {
+	anchors map[string]any
+}
+
+// load converts node and its children.
+func (l *loader) load(node ast.Node) (any, error) {
+	switch n := node.(type) {
+	case *ast.DocumentNode:
+		return l.load(n.Body)
+	case *ast.AnchorNode:
+		value, err := l.load(n.Value)
+		if err != nil {
+			return nil, err
+		}
+		l.anchors[n.Name.GetToken().Value] = value
+		return value, nil
+	case *ast.AliasNode:
+		value, has := l.anchors[n.Value.GetToken().Value]
+		if !has {
+			return nil, fmt.Errorf("cannot load alias: unknown anchor %v", n.Value.GetToken().Value)
+		}
+		return value, nil
+	case *ast.TagNode:
+		return l.loadTagged(n)
+	case *ast.MappingNode:
+		return l.loadMapping(n.Values)
+	case *ast.MappingValueNode:
+		return l.loadMapping([]*ast.MappingValueNode{n})
+	case *ast.SequenceNode:
+		list := make([]any, 0, len(n.Values))
+		for _, item := range n.Values {
+			value, err := l.load(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case *ast.LiteralNode:
+		return n.Value.Value, nil
+	case *ast.MappingKeyNode:
+		return l.load(n.Value)
+	case *ast.MergeKeyNode:
+		return "<<", nil
+	case nil, *ast.NullNode:
+		return nil, nil
+	case ast.ScalarNode:
+		return resolveScalar(n.GetToken())
+	default:
+		return nil, fmt.Errorf("cannot load node: unsupported node type %v", node.Type())
+	}
+}
+
+// loadMapping converts the entries of a mapping, applying merge keys ("<<")
+// the same way PyYAML does: merged entries come first and are overridden by
+// the mapping's own entries.
+func (l *loader) loadMapping(pairs []*ast.MappingValueNode) (orderedMap, error) {
+	var merged orderedMap
+	var own orderedMap
+	for _, pair := range pairs {
+		if _, isMerge := pair.Key.(*ast.MergeKeyNode); isMerge {
+			value, err := l.load(pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			sources := []any{value}
+			if list, ok := value.([]any); ok {
+				sources = list
+			}
+			for _, source := range sources {
+				m, ok := source.(orderedMap)
+				if !ok {
+					return nil, fmt.Errorf("cannot load merge key: value is not a mapping")
+				}
+				for _, item := range m {
+					if _, has := merged.get(item.Key); !has {
+						merged = append(merged, item)
+					}
+				}
+			}
+			continue
+		}
+
+		key, err := l.load(pair.Key)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case orderedMap, []any, []byte:
+			return nil, fmt.Errorf("cannot load mapping: unhashable key")
+		}
+		value, err := l.load(pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		own.set(key, value)
+	}
+
+	m := append(orderedMap{}, merged...)
+	for _, item := range own {
+		m.set(item.Key, item.Value)
+	}
+	return m, nil
+}
+
+// loadTagged converts a node with an explicit tag.
+func (l *loader) loadTagged(n *ast.TagNode) (any, error) {
+	tag := n.Start.Value
+	switch tag {
+	case "!!binary", "tag:yaml.org,2002:binary":
+		value, err := l.load(n.Value)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot load binary value: value is not a string")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode binary value: %w", err)
+		}
+		return decoded, nil
+	case "!!str", "tag:yaml.org,2002:str":
+		if token := n.Value.GetToken(); token != nil {
+			if _, ok := n.Value.(*ast.LiteralNode); !ok {
+				return token.Value, nil
+			}
+		}
+		return l.load(n.Value)
+	case "!!map", "!!seq", "tag:yaml.org,2002:map", "tag:yaml.org,2002:seq":
+		return l.load(n.Value)
+	default:
+		return nil, fmt.Errorf("cannot load tagged value: unsupported tag %v", tag)
+	}
+}
+
+// resolveScalar returns the value of a scalar token, resolving plain scalars
+// with the YAML 1.1 rules used by PyYAML.
+func resolveScalar(t *token.Token) (any, error) {
+	if t == nil {
+		return nil, nil
+	}
+	if t.Type == token.SingleQuoteType || t.Type == token.DoubleQuoteType {
+		return t.Value, nil
+	}
+
+	value := t.Value
+	switch {
+	case yaml11Null.MatchString(value):
+		return nil, nil
+	case yaml11Bool.MatchString(value):
+		switch strings.ToLower(value) {
+		case "yes", "true", "on":
+			return true, nil
+		}
+		return false, nil
+	case yaml11Int.MatchString(value):
+		return resolveInt(value)
+	case yaml11Float.MatchString(value):
+		return resolveFloat(value)
+	case yaml11Date.MatchString(value):
+		date, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse date: %w", err)
+		}
+		return pyDate{year: date.Year(), month: int(date.Month()), day: date.Day()}, nil
+	case yaml11Timestamp.MatchString(value):
+		return nil, fmt.Errorf("cannot load timestamp %v: timestamps are not supported", value)
+	}
+
+	return value, nil
+}
+
+// resolveInt parses a YAML 1.1 integer.
+func resolveInt(value string) (*big.Int, error) {
+	value = strings.ReplaceAll(value, "_", "")
+	sign := ""
+	if value[0] == '-' || value[0] == '+' {
+		if value[0] == '-' {
+			sign = "-"
+		}
+		value = value[1:]
+	}
+
+	n := new(big.Int)
+	var ok bool
+	switch {
+	case value == "0":
+		ok = true
+	case strings.HasPrefix(value, "0b"):
+		_, ok = n.SetString(value[2:], 2)
+	case strings.HasPrefix(value, "0x"):
+		_, ok = n.SetString(value[2:], 16)
+	case strings.HasPrefix(value, "0"):
+		_, ok = n.SetString(value[1:], 8)
+	case strings.Contains(value, ":"):
+		ok = true
+		for _, digit := range strings.Split(value, ":") {
+			d, err := strconv.ParseInt(digit, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse integer: %w", err)
+			}
+			n.Mul(n, big.NewInt(60))
+			n.Add(n, big.NewInt(d))
+		}
+	default:
+		_, ok = n.SetString(value, 10)
+	}
+	if !ok {
+		return nil, fmt.Errorf("cannot parse integer: %v", value)
+	}
+	if sign == "-" {
+		n.Neg(n)
+	}
+	return n, nil
+}
+
+// resolveFloat parses a YAML 1.1 floating point number.
+func resolveFloat(value string) (float64, error) {
+	value = strings.ToLower(strings.ReplaceAll(value, "_", ""))
+	sign := 1.0
+	if value[0] == '-' || value[0] == '+' {
+		if value[0] == '-' {
+			sign = -1.0
+		}
+		value = value[1:]
+	}
+
+	switch {
+	case value == ".inf":
+		return sign * math.Inf(1), nil
+	case value == ".nan":
+		return math.NaN(), nil
+	case strings.Contains(value, ":"):
+		f := 0.0
+		for _, digit := range strings.Split(value, ":") {
+			d, err := strconv.ParseFloat(digit, 64)
+			if err != nil {
+				return 0, fmt.Errorf("cannot parse float: %w", err)
+			}
+			f = f*60 + d
+		}
+		return sign * f, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse float: %w", err)
+	}
+	return sign * f, nil
+}
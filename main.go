@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
@@ -11,6 +12,9 @@ import (
 
 	"github.com/redhatinsights/rhc-worker-playbook/internal/config"
 	"github.com/redhatinsights/rhc-worker-playbook/internal/constants"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/history"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/queue"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/redact"
 	"github.com/redhatinsights/yggdrasil/worker"
 	"github.com/urfave/cli/v2"
 	"github.com/urfave/cli/v2/altsrc"
@@ -46,6 +50,38 @@ func main() {
 			Value: config.DefaultConfig.VerifyPlaybook,
 			Usage: "use GPG signature verification before executing a playbook",
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  config.FlagNameVerifyBackend,
+			Value: config.DefaultConfig.VerifyBackend,
+			Usage: "verify playbook signatures using `BACKEND` (native or subprocess)",
+		}),
+		altsrc.NewPathFlag(&cli.PathFlag{
+			Name:  config.FlagNameVerifyKeyringDir,
+			Value: config.DefaultConfig.VerifyKeyringDir,
+			Usage: "trust the public keys in `DIR` when verifying playbook signatures natively",
+		}),
+		altsrc.NewPathFlag(&cli.PathFlag{
+			Name:      config.FlagNamePolicyFile,
+			Value:     config.DefaultConfig.PolicyFile,
+			TakesFile: true,
+			Usage:     "check playbooks against the content policy in `FILE` before running them",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  config.FlagNameTransmitter,
+			Value: config.DefaultConfig.Transmitter,
+			Usage: "transmit events using `TRANSMITTER` (dbus, file or http)",
+		}),
+		altsrc.NewPathFlag(&cli.PathFlag{
+			Name:      config.FlagNameTransmitFile,
+			Value:     config.DefaultConfig.TransmitFile,
+			TakesFile: true,
+			Usage:     "append events to `FILE` when using the file transmitter",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  config.FlagNameTransmitURL,
+			Value: config.DefaultConfig.TransmitURL,
+			Usage: "post events to `URL` when using the http transmitter",
+		}),
 		altsrc.NewDurationFlag(&cli.DurationFlag{
 			Name:   config.FlagNameResponseInterval,
 			Value:  config.DefaultConfig.ResponseInterval,
@@ -53,11 +89,92 @@ func main() {
 			Hidden: true,
 		}),
 		altsrc.NewIntFlag(&cli.IntFlag{
-			Name:   config.FlagNameBatchEvents,
-			Value:  config.DefaultConfig.BatchEvents,
-			Usage:  "number of events to batch together in a single transmision",
-			Hidden: true,
+			Name:  config.FlagNameBatchEvents,
+			Value: config.DefaultConfig.BatchEvents,
+			Usage: "transmit events in batches of up to `NUMBER` events",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  config.FlagNameBatchBytes,
+			Value: config.DefaultConfig.BatchBytes,
+			Usage: "transmit events in batches of up to `SIZE` bytes",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  config.FlagNameBatchLatency,
+			Value: config.DefaultConfig.BatchLatency,
+			Usage: "transmit batched events at most `DURATION` after they occur",
 		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  config.FlagNameCompressEvents,
+			Value: config.DefaultConfig.CompressEvents,
+			Usage: "gzip compress the events uploaded to ingress",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  config.FlagNameRedactPatterns,
+			Value: cli.NewStringSlice(config.DefaultConfig.RedactPatterns...),
+			Usage: "mask the data matching `REGEXP` in job events (may be repeated)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  config.FlagNameEventPreset,
+			Value: config.DefaultConfig.EventPreset,
+			Usage: "transmit the job events selected by `PRESET` (full, summary or failures-only)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  config.FlagNameEventInclude,
+			Value: cli.NewStringSlice(config.DefaultConfig.EventInclude...),
+			Usage: "also transmit job events of type `EVENT` (may be repeated)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  config.FlagNameEventExclude,
+			Value: cli.NewStringSlice(config.DefaultConfig.EventExclude...),
+			Usage: "never transmit job events of type `EVENT` (may be repeated)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  config.FlagNameRetentionMaxAge,
+			Value: config.DefaultConfig.RetentionMaxAge,
+			Usage: "remove the files of runs older than `DURATION`",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  config.FlagNameRetentionMaxRuns,
+			Value: config.DefaultConfig.RetentionMaxRuns,
+			Usage: "keep the files of the `N` most recent runs",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:  config.FlagNameRetentionMaxBytes,
+			Value: config.DefaultConfig.RetentionMaxBytes,
+			Usage: "keep the files of the most recent runs totaling at most `BYTES`",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  config.FlagNameRetentionKeepFailedOnly,
+			Value: config.DefaultConfig.RetentionKeepFailedOnly,
+			Usage: "remove the files of successful runs",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  config.FlagNameHeartbeatInterval,
+			Value: config.DefaultConfig.HeartbeatInterval,
+			Usage: "send a heartbeat event every `DURATION` while a playbook is running",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  config.FlagNameExecutionTimeout,
+			Value: config.DefaultConfig.ExecutionTimeout,
+			Usage: "terminate playbook runs that take longer than `DURATION` (0 disables)",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  config.FlagNameQueueDepth,
+			Value: config.DefaultConfig.QueueDepth,
+			Usage: "queue up to `NUMBER` playbooks while another playbook is running",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  config.FlagNameExtraVarsAllowlist,
+			Value: cli.NewStringSlice(config.DefaultConfig.ExtraVarsAllowlist...),
+			Usage: "allow messages to set the extra var `NAME` (may be repeated)",
+		}),
+	}
+
+	app.Commands = []*cli.Command{
+		runCommand,
+		verifyCommand,
+		listRunsCommand,
+		showRunCommand,
 	}
 
 	app.Before = beforeAction
@@ -94,15 +211,70 @@ func mainAction(ctx *cli.Context) error {
 	}
 	slog.SetLogLoggerLevel(level)
 
-	w, err := worker.NewWorker(config.DefaultConfig.Directive, true, nil, nil, rx, nil)
+	runQueue, err = queue.New(
+		filepath.Join(constants.StateDir, "queue"),
+		config.DefaultConfig.QueueDepth,
+	)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("cannot create run queue: %w", err), 1)
+	}
+
+	outboxDir = filepath.Join(constants.StateDir, "outbox")
+
+	runHistory, err = history.Open(filepath.Join(constants.StateDir, "history"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	// Remove the files of past runs that the retention policy no longer
+	// keeps. No run is active yet.
+	applyRetention(nil)
+
+	redactor, err = redact.New(config.DefaultConfig.RedactPatterns)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if _, err := parseEventSelection(nil); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	w, err := worker.NewWorker(
+		config.DefaultConfig.Directive,
+		true,
+		detectFeatures(),
+		cancelRx,
+		rx,
+		dispatcherEvent,
+	)
 	if err != nil {
 		return cli.Exit(fmt.Errorf("cannot create worker: %w", err), 1)
 	}
 
+	transmitter, err = newTransmitter(w)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
 	// Set up a channel to receive the TERM or INT signal over and clean up
 	// before quitting.
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+	var stop context.CancelFunc
+	shutdown, stop = signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// Pick up the work left by the previous worker process as soon as the
+	// worker is connected, without waiting for a new message.
+	go func() {
+		if config.DefaultConfig.Transmitter == config.TransmitterDBus {
+			if err := waitConnected(config.DefaultConfig.Directive); err != nil {
+				slog.Error("cannot recover pending runs:", "err", err)
+				return
+			}
+		}
+		recoverPendingRuns(w)
+	}()
 
 	if err := w.Connect(quit); err != nil {
 		return cli.Exit(fmt.Errorf("cannot connect: %w", err), 1)
@@ -117,8 +289,29 @@ func loadConfigFromContext(ctx *cli.Context) {
 	config.DefaultConfig.Directive = ctx.String(config.FlagNameDirective)
 	config.DefaultConfig.LogLevel = ctx.String(config.FlagNameLogLevel)
 	config.DefaultConfig.VerifyPlaybook = ctx.Bool(config.FlagNameVerifyPlaybook)
+	config.DefaultConfig.VerifyBackend = ctx.String(config.FlagNameVerifyBackend)
+	config.DefaultConfig.VerifyKeyringDir = ctx.Path(config.FlagNameVerifyKeyringDir)
+	config.DefaultConfig.PolicyFile = ctx.Path(config.FlagNamePolicyFile)
+	config.DefaultConfig.Transmitter = ctx.String(config.FlagNameTransmitter)
+	config.DefaultConfig.TransmitFile = ctx.Path(config.FlagNameTransmitFile)
+	config.DefaultConfig.TransmitURL = ctx.String(config.FlagNameTransmitURL)
 	config.DefaultConfig.ResponseInterval = ctx.Duration(config.FlagNameResponseInterval)
 	config.DefaultConfig.BatchEvents = ctx.Int(config.FlagNameBatchEvents)
+	config.DefaultConfig.BatchBytes = ctx.Int(config.FlagNameBatchBytes)
+	config.DefaultConfig.BatchLatency = ctx.Duration(config.FlagNameBatchLatency)
+	config.DefaultConfig.CompressEvents = ctx.Bool(config.FlagNameCompressEvents)
+	config.DefaultConfig.RedactPatterns = ctx.StringSlice(config.FlagNameRedactPatterns)
+	config.DefaultConfig.EventPreset = ctx.String(config.FlagNameEventPreset)
+	config.DefaultConfig.EventInclude = ctx.StringSlice(config.FlagNameEventInclude)
+	config.DefaultConfig.EventExclude = ctx.StringSlice(config.FlagNameEventExclude)
+	config.DefaultConfig.HeartbeatInterval = ctx.Duration(config.FlagNameHeartbeatInterval)
+	config.DefaultConfig.RetentionMaxAge = ctx.Duration(config.FlagNameRetentionMaxAge)
+	config.DefaultConfig.RetentionMaxRuns = ctx.Int(config.FlagNameRetentionMaxRuns)
+	config.DefaultConfig.RetentionMaxBytes = ctx.Int64(config.FlagNameRetentionMaxBytes)
+	config.DefaultConfig.RetentionKeepFailedOnly = ctx.Bool(config.FlagNameRetentionKeepFailedOnly)
+	config.DefaultConfig.ExecutionTimeout = ctx.Duration(config.FlagNameExecutionTimeout)
+	config.DefaultConfig.QueueDepth = ctx.Int(config.FlagNameQueueDepth)
+	config.DefaultConfig.ExtraVarsAllowlist = ctx.StringSlice(config.FlagNameExtraVarsAllowlist)
 }
 
 // parseLevel parses the log level string from the config to an slog.Level
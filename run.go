@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"github.com/google/uuid"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/ansible"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/config"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/redact"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	flagNameCheck          = "check"
+	flagNameDiff           = "diff"
+	flagNameMessageVersion = "message-version"
+)
+
+// runCommand runs a local playbook the way rx runs the playbook of a message,
+// without a connection to the dispatcher.
+var runCommand = &cli.Command{
+	Name:      "run",
+	Usage:     "run a local playbook and print its job events",
+	ArgsUsage: "FILE",
+	Description: "Verifies, checks and runs the playbook in FILE as if it had been " +
+		"received from the server, printing its job events to standard output, " +
+		"one per line. The exit status is zero if the run succeeds.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  flagNameCheck,
+			Usage: "run the playbook in check mode",
+		},
+		&cli.BoolFlag{
+			Name:  flagNameDiff,
+			Usage: "report the changes made by the playbook",
+		},
+		&cli.IntFlag{
+			Name:  flagNameMessageVersion,
+			Value: ansible.MessageVersion1,
+			Usage: "print job events in version `VERSION` of the message schema",
+		},
+	},
+	Action: runAction,
+}
+
+func runAction(ctx *cli.Context) error {
+	loadConfigFromContext(ctx)
+	level, err := parseLevel(config.DefaultConfig.LogLevel)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	slog.SetLogLoggerLevel(level)
+
+	if ctx.NArg() != 1 {
+		return cli.Exit("usage: run FILE", 1)
+	}
+	if !slices.Contains(ansible.MessageVersions, ctx.Int(flagNameMessageVersion)) {
+		return cli.Exit(fmt.Errorf("unsupported message version: %v", ctx.Int(flagNameMessageVersion)), 1)
+	}
+
+	runRedactor, err := redact.New(config.DefaultConfig.RedactPatterns)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	eventSelection, err := parseEventSelection(nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	data, err := os.ReadFile(ctx.Args().First())
+	if err != nil {
+		return cli.Exit(fmt.Errorf("cannot read playbook: %w", err), 1)
+	}
+
+	playbook := data
+	if config.DefaultConfig.VerifyPlaybook {
+		playbook, _, err = verifyPlaybook(data)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot verify playbook: %w", err), 1)
+		}
+	}
+
+	playbook, err = stripSignature(playbook)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("cannot strip playbook signature: %w", err), 1)
+	}
+
+	if err := checkPolicy(playbook); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	// Stop the run if interrupted, and bound it by the execution timeout.
+	runCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if config.DefaultConfig.ExecutionTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		runCtx, cancelTimeout = context.WithTimeoutCause(
+			runCtx,
+			config.DefaultConfig.ExecutionTimeout,
+			errRunTimedOut,
+		)
+		defer cancelTimeout()
+	}
+
+	// Print job events as they are received.
+	events := make(chan json.RawMessage)
+	printEventsDone := make(chan struct{})
+	go func() {
+		defer close(printEventsDone)
+		for event := range events {
+			fmt.Println(string(event))
+		}
+	}()
+
+	runner := ansible.NewRunner(
+		uuid.New().String(),
+		ansible.RunOptions{
+			CheckMode: ctx.Bool(flagNameCheck),
+			Diff:      ctx.Bool(flagNameDiff),
+		},
+		events,
+	)
+	runner.SetRedactor(runRedactor)
+	runner.SetEventSelection(eventSelection)
+	runner.SetMessageVersion(ctx.Int(flagNameMessageVersion))
+	err = runner.Run(runCtx, playbook)
+
+	close(events)
+	<-printEventsDone
+
+	return runExit(runner.Result, err)
+}
+
+// runExit returns the error runAction exits with once the run is over. A
+// completed run that did not succeed exits with the return code of
+// ansible-playbook, or 1 if it has none; a run that did not complete exits
+// with 1.
+func runExit(result *ansible.Result, err error) error {
+	if result == nil {
+		return cli.Exit(fmt.Errorf("cannot run playbook: %w", err), 1)
+	}
+	if result.Status != "successful" {
+		code := result.RC
+		if code <= 0 {
+			code = 1
+		}
+		return cli.Exit(fmt.Sprintf("playbook run %v", result.Status), code)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/redhatinsights/rhc-worker-playbook/internal/ansible"
+	"github.com/urfave/cli/v2"
+)
+
+func TestRunExit(t *testing.T) {
+	tests := []struct {
+		description string
+		result      *ansible.Result
+		err         error
+		want        int
+	}{
+		{
+			description: "successful",
+			result:      &ansible.Result{Status: "successful", RC: 0},
+			want:        0,
+		},
+		{
+			description: "failed",
+			result:      &ansible.Result{Status: "failed", RC: 2},
+			err:         errors.New("playbook run failed"),
+			want:        2,
+		},
+		{
+			description: "failed without return code",
+			result:      &ansible.Result{Status: "failed", RC: -1},
+			err:         errors.New("playbook run failed"),
+			want:        1,
+		},
+		{
+			description: "not completed",
+			err:         errors.New("cannot start ansible-runner"),
+			want:        1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := runExit(test.result, test.err)
+			got := 0
+			var exitErr cli.ExitCoder
+			if errors.As(err, &exitErr) {
+				got = exitErr.ExitCode()
+			}
+			if got != test.want {
+				t.Errorf("got: %v want: %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errRunCancelled is the cause attached to a run's context when the run is
+// cancelled by the dispatcher.
+var errRunCancelled = errors.New("playbook run cancelled")
+
+// errRunTimedOut is the cause attached to a run's context when the run exceeds
+// its execution timeout.
+var errRunTimedOut = errors.New("playbook run timed out")
+
+// activeRun holds the identity of a message being processed by rx along with
+// the function that cancels its context.
+type activeRun struct {
+	messageId     string
+	correlationId string
+	cancel        context.CancelCauseFunc
+}
+
+// runRegistry tracks the messages currently being processed so that they can
+// be looked up and cancelled by either their message ID or their correlation
+// ID.
+type runRegistry struct {
+	lock sync.Mutex
+	runs map[string]*activeRun
+}
+
+// activeRuns is the registry of all messages currently being processed by rx.
+var activeRuns = runRegistry{
+	runs: map[string]*activeRun{},
+}
+
+// add registers a run under its message ID.
+func (r *runRegistry) add(messageId, correlationId string, cancel context.CancelCauseFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.runs[messageId] = &activeRun{
+		messageId:     messageId,
+		correlationId: correlationId,
+		cancel:        cancel,
+	}
+}
+
+// remove unregisters the run identified by messageId.
+func (r *runRegistry) remove(messageId string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.runs, messageId)
+}
+
+// correlationIds returns the correlation IDs of the registered runs.
+func (r *runRegistry) correlationIds() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ids := make([]string, 0, len(r.runs))
+	for _, run := range r.runs {
+		ids = append(ids, run.correlationId)
+	}
+	return ids
+}
+
+// cancel cancels the run whose message ID or correlation ID matches id. It
+// returns false if no such run is registered.
+func (r *runRegistry) cancel(id string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, run := range r.runs {
+		if run.messageId == id || run.correlationId == id {
+			run.cancel(errRunCancelled)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunRegistryCancel(t *testing.T) {
+	tests := []struct {
+		description string
+		cancelID    string
+		wantFound   bool
+	}{
+		{
+			description: "cancel by message id",
+			cancelID:    "6f5e0e4c-2b8f-4d8e-9a6c-2b7e8f9d0a11",
+			wantFound:   true,
+		},
+		{
+			description: "cancel by correlation id",
+			cancelID:    "dcdc7b28-6800-4af9-983a-60fda58a7156",
+			wantFound:   true,
+		},
+		{
+			description: "unknown id",
+			cancelID:    "00000000-0000-0000-0000-000000000000",
+			wantFound:   false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			registry := runRegistry{runs: map[string]*activeRun{}}
+			ctx, cancel := context.WithCancelCause(context.Background())
+			defer cancel(nil)
+			registry.add(
+				"6f5e0e4c-2b8f-4d8e-9a6c-2b7e8f9d0a11",
+				"dcdc7b28-6800-4af9-983a-60fda58a7156",
+				cancel,
+			)
+
+			got := registry.cancel(test.cancelID)
+			if got != test.wantFound {
+				t.Fatalf("got: %v want: %v", got, test.wantFound)
+			}
+
+			cancelled := errors.Is(context.Cause(ctx), errRunCancelled)
+			if cancelled != test.wantFound {
+				t.Errorf("context cancelled: got: %v want: %v", cancelled, test.wantFound)
+			}
+		})
+	}
+
+	t.Run("removed runs cannot be cancelled", func(t *testing.T) {
+		registry := runRegistry{runs: map[string]*activeRun{}}
+		registry.add("a", "b", func(error) {})
+		registry.remove("a")
+		if registry.cancel("a") {
+			t.Error("removed run should not be found")
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/redhatinsights/yggdrasil/ipc"
+	"github.com/redhatinsights/yggdrasil/worker"
+)
+
+// Stages of processing a message, reported to the dispatcher in WORKING worker
+// events so that local tools such as yggctl can show the progress of a run.
+// The dispatcher is told when the worker starts and stops, and when it begins
+// and ends processing a message, by the worker package itself.
+const (
+	statusReceived     = "received"
+	statusVerified     = "verified"
+	statusRunning      = "running"
+	statusTransmitting = "transmitting"
+	statusFinished     = "finished"
+)
+
+// emitStatus emits a WORKING worker event for the message identified by id,
+// carrying status in its "message" data field. Status events are
+// informational, so failing to emit one is only logged.
+func emitStatus(w *worker.Worker, id string, responseTo string, status string) {
+	if w == nil {
+		return
+	}
+	if err := w.EmitEvent(
+		ipc.WorkerEventNameWorking,
+		id,
+		responseTo,
+		map[string]string{"message": status},
+	); err != nil {
+		slog.Warn("cannot emit worker event:", "message-id", id, "status", status, "err", err)
+	}
+}
+
+// dispatcherEvent is the worker's event handler. It logs the events emitted by
+// the dispatcher about its connection to the server.
+func dispatcherEvent(e ipc.DispatcherEvent) {
+	switch e {
+	case ipc.DispatcherEventReceivedDisconnect:
+		slog.Info("dispatcher received disconnect")
+	case ipc.DispatcherEventUnexpectedDisconnect:
+		slog.Warn("dispatcher disconnected unexpectedly")
+	case ipc.DispatcherEventConnectionRestored:
+		slog.Info("dispatcher connection restored")
+	default:
+		slog.Debug("received unknown dispatcher event:", "event", e)
+	}
+}
+
+// waitConnected waits until the worker for directive owns its name on the bus,
+// which the worker requests once it is ready to receive messages and transmit
+// data. It gives up after a minute.
+func waitConnected(directive string) error {
+	var conn *dbus.Conn
+	var err error
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") != "" {
+		conn, err = dbus.ConnectSessionBus()
+	} else {
+		conn, err = dbus.ConnectSystemBus()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot connect to bus: %w", err)
+	}
+	defer conn.Close()
+
+	name := "com.redhat.Yggdrasil1.Worker1." + directive
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(time.Minute)
+	for {
+		var owned bool
+		err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, name).Store(&owned)
+		if err != nil {
+			return fmt.Errorf("cannot look up bus name: name=%v err=%w", name, err)
+		}
+		if owned {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return fmt.Errorf("worker did not connect: name=%v", name)
+		}
+	}
+}
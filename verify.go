@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/redhatinsights/rhc-worker-playbook/internal/config"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/verify"
+	"github.com/urfave/cli/v2"
+)
+
+// verifyCommand checks the signature of a local playbook, reporting the
+// details of the verification of each play.
+var verifyCommand = &cli.Command{
+	Name:      "verify",
+	Usage:     "check the signature of a local playbook",
+	ArgsUsage: "FILE",
+	Description: "Verifies the signature of each play of the playbook in FILE against " +
+		"the public keys in the keyring directory, reporting the key that signed " +
+		"the play, the paths excluded from the signature and the signed content. " +
+		"If the subprocess verification backend is configured, the playbook is " +
+		"also verified by rhc-playbook-verifier, as it is when received from the " +
+		"server. The exit status is zero if every play and the configured backend " +
+		"verify.",
+	Action: verifyAction,
+}
+
+func verifyAction(ctx *cli.Context) error {
+	loadConfigFromContext(ctx)
+	level, err := parseLevel(config.DefaultConfig.LogLevel)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	slog.SetLogLoggerLevel(level)
+
+	if ctx.NArg() != 1 {
+		return cli.Exit("usage: verify FILE", 1)
+	}
+
+	data, err := os.ReadFile(ctx.Args().First())
+	if err != nil {
+		return cli.Exit(fmt.Errorf("cannot read playbook: %w", err), 1)
+	}
+
+	return verifyLocalPlaybook(os.Stdout, data)
+}
+
+// verifyLocalPlaybook writes a report of the verification of each play of data
+// against the public keys in the configured keyring directory to w. If the
+// subprocess verification backend is configured, data must also pass
+// rhc-playbook-verifier.
+func verifyLocalPlaybook(w io.Writer, data []byte) error {
+	backend := config.DefaultConfig.VerifyBackend
+	if backend != config.VerifyBackendNative && backend != config.VerifyBackendSubprocess {
+		return cli.Exit(fmt.Errorf("unknown verification backend %v", backend), 1)
+	}
+
+	verifier, err := newNativeVerifier()
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	reports, err := verifier.Diagnose(data)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("cannot verify playbook: %w", err), 1)
+	}
+
+	failed := 0
+	for _, report := range reports {
+		writePlayReport(w, report)
+		if report.Err != nil {
+			failed++
+		}
+	}
+
+	if backend == config.VerifyBackendSubprocess {
+		if _, err := verifyPlaybookSubprocess(data); err != nil {
+			fmt.Fprintf(w, "rhc-playbook-verifier: FAILED: %v\n", err)
+			return cli.Exit("playbook failed verification by rhc-playbook-verifier", 1)
+		}
+		fmt.Fprintln(w, "rhc-playbook-verifier: verified")
+	}
+
+	if failed > 0 {
+		return cli.Exit(fmt.Sprintf("%v of %v plays failed verification", failed, len(reports)), 1)
+	}
+
+	return nil
+}
+
+// writePlayReport writes a human readable description of report to w.
+func writePlayReport(w io.Writer, report verify.PlayReport) {
+	result := "verified"
+	if report.Err != nil {
+		result = "FAILED: " + report.Err.Error()
+	}
+	fmt.Fprintf(w, "play %v %q: %v\n", report.Index, report.Name, result)
+	fmt.Fprintf(w, "  key ID:         %v\n", valueOrNone(report.KeyID))
+	fmt.Fprintf(w, "  fingerprint:    %v\n", valueOrNone(report.Fingerprint))
+	fmt.Fprintf(w, "  excluded paths: %v\n", valueOrNone(strings.Join(report.Exclusions, ", ")))
+	fmt.Fprintf(w, "  signed content: %v\n", valueOrNone(report.Signed))
+}
+
+// valueOrNone returns s, or "(none)" if s is empty.
+func valueOrNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
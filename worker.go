@@ -2,18 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
 	"github.com/redhatinsights/rhc-worker-playbook/internal/ansible"
 	"github.com/redhatinsights/rhc-worker-playbook/internal/config"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/constants"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/history"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/outbox"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/policy"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/queue"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/redact"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/retention"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/transmit"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/verify"
 	"github.com/redhatinsights/yggdrasil/worker"
 )
 
@@ -25,7 +42,34 @@ type Play struct {
 	Tasks  []yaml.MapSlice `yaml:"tasks"`
 }
 
-var playbookAlreadyRunning sync.Mutex
+// runQueue holds the messages waiting for their playbook to run. Only the
+// message at the head of the queue runs a playbook.
+var runQueue *queue.Queue
+
+// outboxDir is the directory holding the outboxes of runs whose events have
+// not yet been acknowledged.
+var outboxDir string
+
+// redactor masks sensitive data in the job events of every run.
+var redactor *redact.Redactor
+
+// transmitter sends the events of every run to their destination.
+var transmitter transmit.Transmitter
+
+// runHistory records every message processed by rx.
+var runHistory *history.Store
+
+// retentionLock serializes the applications of the retention policy.
+var retentionLock sync.Mutex
+
+// correlationIdPattern matches the correlation IDs that rx accepts. The
+// correlation ID names the files of the run and is passed to ansible-runner,
+// so it is limited to the characters of a UUID or a similar token.
+var correlationIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// shutdown is cancelled when the worker is asked to quit, abandoning any
+// retried transmission of events. The events are left in their outbox.
+var shutdown = context.Background()
 
 func init() {
 	// Register a custom unmarshaler to support the YAML 1.1 boolean types
@@ -72,6 +116,9 @@ func rx(
 	if !has {
 		return fmt.Errorf("invalid metadata: missing crc_dispatcher_correlation_id")
 	}
+	if !correlationIdPattern.MatchString(correlationId) {
+		return fmt.Errorf("invalid metadata: invalid crc_dispatcher_correlation_id: %q", correlationId)
+	}
 
 	// Get responseInterval from metadata, conditionally overriding it with the
 	// value loaded from the configuration file.
@@ -88,13 +135,41 @@ func rx(
 		responseInterval = config.DefaultConfig.ResponseInterval
 	}
 
-	// Adjust responseInterval for batching mode.
-	if config.DefaultConfig.BatchEvents > 0 {
-		// Set the response interval to 500ms when batching events. This has the
-		// effect of matching the "<-timeout" case every time the channel select
-		// statement evaluates. This allows the same codepath to work when
-		// either batching events by quantity or by timeout.
-		responseInterval = 500 * time.Millisecond
+	// Register the message so that it can be cancelled by cancelRx while it
+	// is being processed.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	activeRuns.add(id, correlationId, cancel)
+	defer activeRuns.remove(id)
+
+	emitStatus(w, id, responseTo, statusReceived)
+
+	// Get the execution timeout from metadata, falling back to the value
+	// loaded from the configuration file. Invalid values in metadata, here and
+	// below, are only reported after the "executor_on_start" event, so that
+	// the run is seen to fail.
+	executionTimeout, timeoutErr := parseExecutionTimeout(metadata)
+
+	// Get the check mode, diff and job event message schema version options
+	// from metadata.
+	runOptions, messageVersion, optionsErr := parseRunOptions(metadata)
+
+	// Get the job event selection from metadata, falling back to the values
+	// loaded from the configuration file.
+	eventSelection, selectionErr := parseEventSelection(metadata)
+	if selectionErr != nil {
+		selectionErr = fmt.Errorf("cannot parse event selection: err=%w", selectionErr)
+	}
+
+	// Build the batch policy. When batching, events wait no longer than the
+	// response interval unless a batch latency is configured.
+	batchPolicy := ansible.BatchPolicy{
+		MaxEvents:  config.DefaultConfig.BatchEvents,
+		MaxBytes:   config.DefaultConfig.BatchBytes,
+		MaxLatency: config.DefaultConfig.BatchLatency,
+	}
+	if batchPolicy.Enabled() && batchPolicy.MaxLatency == 0 {
+		batchPolicy.MaxLatency = responseInterval
 	}
 
 	// events is a channel for communication between the Runner and EventManager goroutines
@@ -108,10 +183,28 @@ func rx(
 		correlationId,
 		returnURL,
 		responseInterval,
-		w,
+		transmitter,
 		events,
 		stopTransmittingEvents,
 	)
+	eventManager.SetCheckMode(runOptions.CheckMode)
+	eventManager.SetBatchPolicy(batchPolicy)
+	eventManager.SetCompression(compressEvents(metadata))
+	eventManager.SetHeartbeatInterval(config.DefaultConfig.HeartbeatInterval)
+
+	// Record the run's events on disk until the server acknowledges them. If
+	// the outbox cannot be created, events are still transmitted, but are lost
+	// if the worker exits before they are acknowledged.
+	eventOutbox, err := outbox.Create(outboxDir, outbox.Metadata{
+		MessageID:     id,
+		CorrelationID: correlationId,
+		ReturnURL:     returnURL,
+	})
+	if err != nil {
+		slog.Error("cannot create outbox:", "message-id", id, "err", err)
+	} else {
+		eventManager.SetOutbox(eventOutbox)
+	}
 
 	// Start the goroutine processing events from the runner
 	processEventsDone := make(chan struct{})
@@ -119,7 +212,18 @@ func rx(
 
 	// Start the goroutine to transmit the set of cached events back to yggdrasil
 	transmitCachedEventsDone := make(chan struct{})
-	go eventManager.TransmitCachedEvents(transmitCachedEventsDone)
+	go eventManager.TransmitCachedEvents(shutdown, transmitCachedEventsDone)
+
+	// Record the message in the run history. The record is completed once the
+	// run's events have been transmitted.
+	historyRecord := history.Run{
+		MessageID:      id,
+		CorrelationID:  correlationId,
+		ReturnURL:      returnURL,
+		PlaybookSHA256: fmt.Sprintf("%x", sha256.Sum256(data)),
+		Started:        time.Now(),
+	}
+	saveHistory(historyRecord)
 
 	// Channel and goroutine teardown
 	defer func() {
@@ -128,8 +232,24 @@ func rx(
 		<-processEventsDone
 
 		// End transmitCachedEvents, wait for the last transmit
+		emitStatus(w, id, responseTo, statusTransmitting)
 		close(stopTransmittingEvents)
 		<-transmitCachedEventsDone
+		emitStatus(w, id, responseTo, statusFinished)
+
+		historyRecord.Finished = time.Now()
+		historyRecord.TransmitOutcome = eventManager.TransmitOutcome()
+		saveHistory(historyRecord)
+
+		// Remove the files of past runs, including this one, that the
+		// retention policy no longer keeps.
+		var active []string
+		for _, activeId := range activeRuns.correlationIds() {
+			if activeId != correlationId {
+				active = append(active, activeId)
+			}
+		}
+		applyRetention(active)
 	}()
 
 	// emitFailureEvent processes common errors as "executor_on_failed" events,
@@ -138,6 +258,7 @@ func rx(
 	// If `SendExecutorOnFailedEvent` returns an error, the errors are combined
 	// and returned.
 	emitFailureEvent := func(originalError error, errorKey string) error {
+		historyRecord.ErrorKey = errorKey
 		if err := eventManager.SendExecutorOnFailedEvent(
 			errorKey,
 			originalError,
@@ -148,44 +269,162 @@ func rx(
 		return originalError
 	}
 
+	// Verify the playbook. The outcome is only reported after the
+	// "executor_on_start" event, which identifies the keys that signed the
+	// playbook.
+	playbook := data
+	var signingKeys []string
+	var verifyErr error
+	historyRecord.Verification = history.VerificationDisabled
+	if config.DefaultConfig.VerifyPlaybook {
+		playbook, signingKeys, verifyErr = verifyPlaybook(data)
+		historyRecord.Verification = history.VerificationPassed
+		if verifyErr != nil {
+			historyRecord.Verification = history.VerificationFailed
+		}
+		historyRecord.SigningKeys = signingKeys
+	}
+
 	// Publish an "executor_on_start" event to signal cloud connector that a run
 	// event has started
-	if err := eventManager.SendExecutorOnStartEvent(); err != nil {
+	if err := eventManager.SendExecutorOnStartEvent(signingKeys); err != nil {
 		return err
 	}
 
-	// Try and lock the mutex.
-	// If the lock is successful, continue.
-	// If the lock is unsuccessful, a playbook is already running. Send an error to remediations and exit.
-	if !playbookAlreadyRunning.TryLock() {
-		// playbook is currently in progress
-		playbookAlreadyRunningErr := errors.New(
-			"a playbook run is already in progress, please wait until the current playbook finishes before executing another",
-		)
-		return emitFailureEvent(playbookAlreadyRunningErr, "ANSIBLE_PLAYBOOK_ALREADY_RUNNING")
+	if timeoutErr != nil {
+		return emitFailureEvent(timeoutErr, "ANSIBLE_PLAYBOOK_TIMEOUT_VALIDATION_FAILED")
+	}
+
+	if optionsErr != nil {
+		return emitFailureEvent(optionsErr, "ANSIBLE_PLAYBOOK_OPTIONS_VALIDATION_FAILED")
+	}
+
+	if selectionErr != nil {
+		return emitFailureEvent(selectionErr, "ANSIBLE_EVENT_SELECTION_VALIDATION_FAILED")
+	}
+
+	if verifyErr != nil {
+		return emitFailureEvent(verifyErr, "ANSIBLE_PLAYBOOK_SIGNATURE_VALIDATION_FAILED")
+	}
+
+	// Strip the signature - also verifies the data is YAML
+	playbook, err = stripSignature(playbook)
+	if err != nil {
+		return emitFailureEvent(err, "ANSIBLE_YAML_VALIDATION_FAILED")
 	}
 
-	// Unlock the mutex after the playbook run
-	defer playbookAlreadyRunning.Unlock()
+	// Check the playbook against the local content policy
+	if err := checkPolicy(playbook); err != nil {
+		var violation *policy.Violation
+		if errors.As(err, &violation) {
+			return emitFailureEvent(err, "ANSIBLE_PLAYBOOK_POLICY_VIOLATION")
+		}
+		return emitFailureEvent(err, "UNDEFINED_ERROR")
+	}
 
-	// Verify the playbook
 	if config.DefaultConfig.VerifyPlaybook {
-		data, err = verifyPlaybook(data)
+		emitStatus(w, id, responseTo, statusVerified)
+	}
+
+	// Parse and validate extra vars from metadata.
+	if extraVarsString, has := metadata["extra_vars"]; has {
+		runOptions.ExtraVars, err = parseExtraVars(
+			extraVarsString,
+			config.DefaultConfig.ExtraVarsAllowlist,
+		)
 		if err != nil {
-			return emitFailureEvent(err, "ANSIBLE_PLAYBOOK_SIGNATURE_VALIDATION_FAILED")
+			return emitFailureEvent(err, "ANSIBLE_EXTRA_VARS_VALIDATION_FAILED")
 		}
 	}
 
-	// Strip the signature - also verifies the data is YAML
-	data, err = stripSignature(data)
+	// Add the message to the run queue. If no other playbook is running, the
+	// message is at the head of the queue and runs immediately. Otherwise, it
+	// waits for the runs ahead of it to finish. If the queue is full, send an
+	// error to remediations and exit.
+	position, ready, err := runQueue.Enqueue(queue.Message{
+		Addr:       addr,
+		ID:         id,
+		ResponseTo: responseTo,
+		Metadata:   metadata,
+		Data:       data,
+	})
 	if err != nil {
-		return emitFailureEvent(err, "ANSIBLE_YAML_VALIDATION_FAILED")
+		if errors.Is(err, queue.ErrQueueFull) {
+			playbookAlreadyRunningErr := errors.New(
+				"a playbook run is already in progress and the run queue is full, please wait until the current playbook finishes before executing another",
+			)
+			return emitFailureEvent(playbookAlreadyRunningErr, "ANSIBLE_PLAYBOOK_ALREADY_RUNNING")
+		}
+		return emitFailureEvent(err, "UNDEFINED_ERROR")
+	}
+
+	// Remove the message from the queue after the playbook run, allowing the
+	// next message to run.
+	defer runQueue.Remove(id)
+
+	if position > 0 {
+		slog.Info("message queued:", "message-id", id, "position", position)
+		if err := eventManager.SendExecutorOnQueuedEvent(position); err != nil {
+			return err
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return emitFailureEvent(context.Cause(ctx), "ANSIBLE_PLAYBOOK_RUN_CANCELLED")
+		}
+		slog.Info("message dequeued:", "message-id", id)
+	}
+
+	// Bound the run by the execution timeout, if one is set.
+	runCtx := ctx
+	if executionTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		runCtx, cancelTimeout = context.WithTimeoutCause(ctx, executionTimeout, errRunTimedOut)
+		defer cancelTimeout()
 	}
 
 	// Create the playbook runner and run the playbook
-	err = ansible.NewRunner(correlationId, events).Run(data)
+	runner := ansible.NewRunner(correlationId, runOptions, events)
+	runner.SetRedactor(redactor)
+	runner.SetEventSelection(eventSelection)
+	runner.SetMessageVersion(messageVersion)
+
+	// Send heartbeats while the playbook runs, so that long-running tasks
+	// that write no job events are not mistaken for a dead worker.
+	stopHeartbeats := make(chan struct{})
+	heartbeatsDone := make(chan struct{})
+	go eventManager.SendHeartbeats(runner.Progress, stopHeartbeats, heartbeatsDone)
+
+	emitStatus(w, id, responseTo, statusRunning)
+	err = runner.Run(runCtx, playbook)
+	historyRecord.Status = runner.Status
+
+	close(stopHeartbeats)
+	<-heartbeatsDone
+
+	// The playbook may have changed what the worker is able to run, such as
+	// by upgrading ansible-core or installing collections.
+	go refreshFeatures(w)
+
+	// Publish an "executor_on_complete" event summarizing the run if
+	// ansible-runner completed it, whether or not the playbook succeeded.
+	if runner.Result != nil {
+		if err := eventManager.SendExecutorOnCompleteEvent(*runner.Result); err != nil {
+			slog.Error("cannot send executor_on_complete event:", "err", err)
+		}
+	}
 
 	if err != nil {
+		if errors.Is(err, errRunCancelled) {
+			return emitFailureEvent(err, "ANSIBLE_PLAYBOOK_RUN_CANCELLED")
+		}
+		if errors.Is(err, errRunTimedOut) {
+			return emitFailureEvent(
+				fmt.Errorf("%w: timeout=%v", err, executionTimeout),
+				"ANSIBLE_PLAYBOOK_RUN_TIMEOUT",
+			)
+		}
 		playbookRunError := fmt.Errorf("cannot run playbook: err=%w", err)
 		return emitFailureEvent(playbookRunError, "UNDEFINED_ERROR")
 	}
@@ -193,13 +432,451 @@ func rx(
 	return nil
 }
 
-// verifyPlaybook calls out via subprocess to rhc-playbook-verifier,
+// parseRunOptions returns the check mode and diff options set by the
+// "check_mode" and "diff" metadata keys, and the job event message schema
+// version set by the "crc_message_version" key.
+func parseRunOptions(metadata map[string]string) (ansible.RunOptions, int, error) {
+	var options ansible.RunOptions
+	var err error
+	if checkModeString, has := metadata["check_mode"]; has {
+		options.CheckMode, err = strconv.ParseBool(checkModeString)
+		if err != nil {
+			return ansible.RunOptions{}, 0, fmt.Errorf("cannot parse check_mode: err=%w", err)
+		}
+	}
+	if diffString, has := metadata["diff"]; has {
+		options.Diff, err = strconv.ParseBool(diffString)
+		if err != nil {
+			return ansible.RunOptions{}, 0, fmt.Errorf("cannot parse diff: err=%w", err)
+		}
+	}
+
+	messageVersion := ansible.MessageVersion1
+	if versionString, has := metadata["crc_message_version"]; has {
+		messageVersion, err = strconv.Atoi(versionString)
+		if err != nil {
+			return ansible.RunOptions{}, 0, fmt.Errorf("cannot parse crc_message_version: err=%w", err)
+		}
+		if !slices.Contains(ansible.MessageVersions, messageVersion) {
+			return ansible.RunOptions{}, 0, fmt.Errorf("unsupported crc_message_version: %v", messageVersion)
+		}
+	}
+
+	return options, messageVersion, nil
+}
+
+// parseExecutionTimeout returns the execution timeout set by the "timeout"
+// metadata key, in seconds, or the timeout configured in the configuration file
+// if the key is missing. Only the configuration file may disable the timeout;
+// a timeout of zero or less in metadata is rejected.
+func parseExecutionTimeout(metadata map[string]string) (time.Duration, error) {
+	timeoutString, has := metadata["timeout"]
+	if !has {
+		return config.DefaultConfig.ExecutionTimeout, nil
+	}
+	timeout, err := time.ParseDuration(strings.TrimSpace(timeoutString) + "s")
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse timeout: err=%w", err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout: timeout must be greater than zero: timeout=%v", timeoutString)
+	}
+	return timeout, nil
+}
+
+// parseEventSelection returns the job event selection configured in the
+// configuration file, overridden by the "event_preset", "event_include" and
+// "event_exclude" metadata keys. The include and exclude lists are comma
+// separated.
+func parseEventSelection(metadata map[string]string) (ansible.EventSelection, error) {
+	selection := ansible.EventSelection{
+		Preset:  config.DefaultConfig.EventPreset,
+		Include: config.DefaultConfig.EventInclude,
+		Exclude: config.DefaultConfig.EventExclude,
+	}
+	if preset, has := metadata["event_preset"]; has {
+		selection.Preset = strings.TrimSpace(preset)
+	}
+	if include, has := metadata["event_include"]; has {
+		selection.Include = splitList(include)
+	}
+	if exclude, has := metadata["event_exclude"]; has {
+		selection.Exclude = splitList(exclude)
+	}
+
+	if err := selection.Validate(); err != nil {
+		return ansible.EventSelection{}, err
+	}
+
+	return selection, nil
+}
+
+// splitList splits a comma separated list, discarding empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// compressEvents reports whether the events of a run are gzip compressed,
+// either because compression is enabled in the configuration or because the
+// message lists "gzip" in its "accept_encoding" metadata key.
+func compressEvents(metadata map[string]string) bool {
+	if config.DefaultConfig.CompressEvents {
+		return true
+	}
+	for _, encoding := range splitList(metadata["accept_encoding"]) {
+		if strings.EqualFold(encoding, "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExtraVars parses data as a JSON object of extra vars. Each variable
+// name must be present in allowlist. Variables whose names collide with the
+// playbook signature variables are always rejected.
+func parseExtraVars(data string, allowlist []string) (map[string]any, error) {
+	var extraVars map[string]any
+	if err := json.Unmarshal([]byte(data), &extraVars); err != nil {
+		return nil, fmt.Errorf("cannot parse extra_vars: err=%w", err)
+	}
+
+	for name := range extraVars {
+		if strings.HasPrefix(name, "insights_signature") {
+			return nil, fmt.Errorf("invalid extra var: %v is a reserved name", name)
+		}
+		if !slices.Contains(allowlist, name) {
+			return nil, fmt.Errorf("invalid extra var: %v is not in the allowlist", name)
+		}
+	}
+
+	return extraVars, nil
+}
+
+// cancelRx is the worker's cancel handler. It cancels the message identified by
+// cancelID, which may be either the ID of the message that started the run or
+// the run's crc_dispatcher_correlation_id. Cancelling a running playbook kills
+// the ansible-runner process tree, causing rx to report the run with an
+// "executor_on_failed" event.
+func cancelRx(w *worker.Worker, addr string, id string, cancelID string) error {
+	slog.Info("cancel received:", "message-id", id, "cancel-id", cancelID)
+
+	if !activeRuns.cancel(cancelID) {
+		return fmt.Errorf("cannot cancel message: no run found for id %v", cancelID)
+	}
+
+	slog.Info("run cancelled:", "cancel-id", cancelID)
+
+	return nil
+}
+
+// recoverPendingRuns picks up the work left by the previous worker process
+// once the worker is connected. The run it interrupted is reported as failed,
+// the events it could not deliver are transmitted, and the messages still
+// queued are resumed in their original order. Outboxes of resumed messages are
+// discarded, since those messages run again and record their events afresh.
+func recoverPendingRuns(w *worker.Worker) {
+	if msg, has := runQueue.Interrupted(); has {
+		failInterruptedRun(msg)
+	}
+
+	restored := runQueue.Restored()
+	pending, err := outbox.Pending(outboxDir)
+	if err != nil {
+		slog.Error("cannot read pending outboxes:", "err", err)
+	}
+	for _, o := range pending {
+		if slices.ContainsFunc(restored, func(msg queue.Message) bool { return msg.ID == o.MessageID }) {
+			if err := o.Close(); err != nil {
+				slog.Error("cannot close outbox:", "message-id", o.MessageID, "err", err)
+			}
+			continue
+		}
+		slog.Info("draining outbox:", "message-id", o.MessageID)
+		go func() {
+			if err := ansible.DrainOutbox(shutdown, transmitter, o); err != nil {
+				slog.Error("cannot drain outbox:", "message-id", o.MessageID, "err", err)
+			}
+		}()
+	}
+
+	for _, msg := range restored {
+		slog.Info("resuming queued message:", "message-id", msg.ID)
+		go func() {
+			// A resumed message that fails before reaching the queue never
+			// claims its restored place, so remove it whatever the outcome
+			// to let the messages behind it run.
+			defer runQueue.Remove(msg.ID)
+			if err := rx(w, msg.Addr, msg.ID, msg.ResponseTo, msg.Metadata, msg.Data); err != nil {
+				slog.Error("cannot resume queued message:", "message-id", msg.ID, "err", err)
+			}
+		}()
+	}
+}
+
+// failInterruptedRun reports the message that was running when the previous
+// worker process exited as failed, rather than running its playbook again and
+// repeating the tasks that were already applied. The "executor_on_failed"
+// event is appended to the run's outbox, to be transmitted along with the
+// run's other pending events, and the run's history record is completed.
+func failInterruptedRun(msg queue.Message) {
+	defer runQueue.Remove(msg.ID)
+
+	slog.Warn("reporting interrupted message as failed:", "message-id", msg.ID)
+	interruptedErr := errors.New("the worker exited while the playbook was running")
+	errorKey := "ANSIBLE_PLAYBOOK_RUN_INTERRUPTED"
+
+	metadata := outbox.Metadata{
+		MessageID:     msg.ID,
+		CorrelationID: msg.Metadata["crc_dispatcher_correlation_id"],
+		ReturnURL:     msg.Metadata["return_url"],
+	}
+	pending, err := outbox.Pending(outboxDir)
+	if err != nil {
+		slog.Error("cannot read pending outboxes:", "err", err)
+	}
+	var o *outbox.Outbox
+	for _, p := range pending {
+		if p.MessageID == msg.ID {
+			o = p
+		} else if err := p.Close(); err != nil {
+			slog.Error("cannot close outbox:", "message-id", p.MessageID, "err", err)
+		}
+	}
+	if o == nil {
+		o, err = outbox.Create(outboxDir, metadata)
+		if err != nil {
+			slog.Error("cannot create outbox:", "message-id", msg.ID, "err", err)
+		}
+	}
+	if o != nil {
+		if err := ansible.AppendExecutorOnFailedEvent(o, errorKey, interruptedErr); err != nil {
+			slog.Error("cannot record executor_on_failed event:", "message-id", msg.ID, "err", err)
+		}
+		if err := o.Close(); err != nil {
+			slog.Error("cannot close outbox:", "message-id", msg.ID, "err", err)
+		}
+	}
+
+	run := history.Run{
+		MessageID:      msg.ID,
+		CorrelationID:  metadata.CorrelationID,
+		ReturnURL:      metadata.ReturnURL,
+		PlaybookSHA256: fmt.Sprintf("%x", sha256.Sum256(msg.Data)),
+	}
+	if runHistory != nil {
+		if recorded, err := runHistory.Get(msg.ID); err == nil {
+			run = recorded
+		}
+	}
+	if run.Started.IsZero() {
+		run.Started = time.Now()
+	}
+	run.Finished = time.Now()
+	run.ErrorKey = errorKey
+	run.TransmitOutcome = ansible.TransmitPending
+	saveHistory(run)
+}
+
+// saveHistory records run in the run history, if there is one. Failing to
+// record a run does not affect the run, so errors are only logged.
+func saveHistory(run history.Run) {
+	if runHistory == nil {
+		return
+	}
+	if err := runHistory.Save(run); err != nil {
+		slog.Error("cannot record run:", "message-id", run.MessageID, "err", err)
+	}
+}
+
+// applyRetention removes the playbooks and ansible-runner artifacts of past
+// runs, and the history records of past messages, that the configured
+// retention policy no longer keeps. The runs whose correlation IDs are in
+// active are left alone.
+func applyRetention(active []string) {
+	policy := retention.Policy{
+		MaxAge:         config.DefaultConfig.RetentionMaxAge,
+		MaxRuns:        config.DefaultConfig.RetentionMaxRuns,
+		MaxBytes:       config.DefaultConfig.RetentionMaxBytes,
+		KeepFailedOnly: config.DefaultConfig.RetentionKeepFailedOnly,
+	}
+	if !policy.Enabled() {
+		return
+	}
+
+	retentionLock.Lock()
+	defer retentionLock.Unlock()
+
+	removeExpiredRuns(policy, active)
+	removeExpiredRecords(policy, active)
+}
+
+// removeExpiredRuns removes the files of the past runs that policy no longer
+// keeps.
+func removeExpiredRuns(policy retention.Policy, active []string) {
+	runs, err := retention.Collect(
+		filepath.Join(constants.PrivateDataDir, "artifacts"),
+		constants.StateDir,
+		active,
+	)
+	if err != nil {
+		slog.Error("cannot collect past runs:", "err", err)
+		return
+	}
+
+	for _, run := range policy.Expired(runs, time.Now()) {
+		slog.Info("removing past run:", "correlation-id", run.ID)
+		if err := retention.Remove(run); err != nil {
+			slog.Error("cannot remove past run:", "correlation-id", run.ID, "err", err)
+		}
+	}
+}
+
+// removeExpiredRecords removes the history records of the past messages that
+// are beyond the age and count limits of policy, judged by when each message
+// finished processing. This includes messages rejected before their run left
+// any file. The other limits only apply to the files of runs.
+func removeExpiredRecords(policy retention.Policy, active []string) {
+	policy = retention.Policy{MaxAge: policy.MaxAge, MaxRuns: policy.MaxRuns}
+	if runHistory == nil || !policy.Enabled() {
+		return
+	}
+
+	records, err := runHistory.List()
+	if err != nil {
+		slog.Error("cannot list run records:", "err", err)
+		return
+	}
+
+	var runs []retention.Run
+	for _, record := range records {
+		if slices.Contains(active, record.CorrelationID) {
+			continue
+		}
+		// A record is left unfinished if the worker exits while processing
+		// its message.
+		finished := record.Finished
+		if finished.IsZero() {
+			finished = record.Started
+		}
+		runs = append(runs, retention.Run{
+			ID:     record.MessageID,
+			Time:   finished,
+			Failed: record.Status != "successful",
+		})
+	}
+
+	for _, run := range policy.Expired(runs, time.Now()) {
+		slog.Info("removing run record:", "message-id", run.ID)
+		if err := runHistory.Remove(run.ID); err != nil {
+			slog.Error("cannot remove run record:", "message-id", run.ID, "err", err)
+		}
+	}
+}
+
+// newTransmitter returns the transmitter selected in the configuration file.
+// The yggdrasil worker w transmits events through the dispatcher.
+func newTransmitter(w *worker.Worker) (transmit.Transmitter, error) {
+	switch config.DefaultConfig.Transmitter {
+	case config.TransmitterDBus:
+		return w, nil
+	case config.TransmitterFile:
+		return transmit.NewFile(config.DefaultConfig.TransmitFile), nil
+	case config.TransmitterHTTP:
+		if config.DefaultConfig.TransmitURL == "" {
+			return nil, fmt.Errorf("cannot create http transmitter: missing %v", config.FlagNameTransmitURL)
+		}
+		return transmit.NewHTTP(config.DefaultConfig.TransmitURL), nil
+	default:
+		return nil, fmt.Errorf("unsupported transmitter: %v", config.DefaultConfig.Transmitter)
+	}
+}
+
+// checkPolicy checks the playbook against the content policy in the
+// configured policy file. The policy is loaded for each playbook so that
+// changes to it apply without restarting the worker.
+func checkPolicy(data []byte) error {
+	p, err := policy.Load(config.DefaultConfig.PolicyFile)
+	if err != nil {
+		return fmt.Errorf("cannot check playbook policy: %w", err)
+	}
+
+	if err := p.Check(data); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// verifyPlaybook verifies the playbook's signature using the verification
+// backend selected in the configuration. If the playbook passes verification,
+// the verified playbook is returned along with the fingerprints of the keys
+// that signed it, if the backend is able to identify them.
+func verifyPlaybook(data []byte) ([]byte, []string, error) {
+	slog.Info("verifying playbook", "backend", config.DefaultConfig.VerifyBackend)
+
+	switch config.DefaultConfig.VerifyBackend {
+	case config.VerifyBackendNative:
+		return verifyPlaybookNative(data)
+	case config.VerifyBackendSubprocess:
+		data, err := verifyPlaybookSubprocess(data)
+		return data, nil, err
+	default:
+		return nil, nil, fmt.Errorf(
+			"cannot verify playbook: unknown verification backend %v",
+			config.DefaultConfig.VerifyBackend,
+		)
+	}
+}
+
+// verifyPlaybookNative verifies the playbook in-process against the public
+// keys in the configured keyring directory. If the playbook passes
+// verification, data is returned unchanged along with the fingerprints of the
+// keys that signed it.
+func verifyPlaybookNative(data []byte) ([]byte, []string, error) {
+	verifier, err := newNativeVerifier()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot verify playbook: %w", err)
+	}
+
+	fingerprints, err := verifier.Verify(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot verify playbook: %w", err)
+	}
+
+	// verification succeeds, log here
+	slog.Info("playbook verified.", "fingerprints", fingerprints)
+
+	return data, fingerprints, nil
+}
+
+// newNativeVerifier returns a Verifier trusting the public keys in the
+// configured keyring directory. The error names the directory, which must hold
+// the public keys that sign playbooks.
+func newNativeVerifier() (*verify.Verifier, error) {
+	dir := config.DefaultConfig.VerifyKeyringDir
+	verifier, err := verify.NewVerifier(dir)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"cannot load keyring: %v=%v must hold the public keys that sign playbooks: err=%w",
+			config.FlagNameVerifyKeyringDir,
+			dir,
+			err,
+		)
+	}
+	return verifier, nil
+}
+
+// verifyPlaybookSubprocess calls out via subprocess to rhc-playbook-verifier,
 // and passes data as the process's standard input.
 // If the playbook passes verification, the stdout
 // of rhc-playbook-verifier is returned
-func verifyPlaybook(data []byte) ([]byte, error) {
-	slog.Info("verifying playbook")
-
+func verifyPlaybookSubprocess(data []byte) ([]byte, error) {
 	stdin := bytes.NewReader(data)
 	stdoutb := new(bytes.Buffer)
 	stderrb := new(bytes.Buffer)
@@ -243,26 +920,176 @@ func verifyPlaybook(data []byte) ([]byte, error) {
 	return stdout, nil
 }
 
+// signatureVars are the play variables that hold a play's signature.
+var signatureVars = []string{"insights_signature", "insights_signature_exclude"}
+
 // stripSignature will confirm the playbook is YAML and return
-// the playbook stripped of "insights_signature" variables
+// the playbook stripped of "insights_signature" variables.
+// The signature variables are located using the YAML syntax tree and cut
+// from the original document, leaving everything else in each play (other
+// keywords, comments, key order, anchors) exactly as it was signed.
 func stripSignature(data []byte) ([]byte, error) {
 	var plays []Play
 	if err := yaml.UnmarshalWithOptions(data, &plays); err != nil {
 		return nil, fmt.Errorf("cannot unmarshal playbook: %v", err)
 	}
 
+	file, err := parser.ParseBytes(data, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse playbook: %v", err)
+	}
+
 	// ansible-runner returns errors when handed binary field values, so
 	// remove the signatures from the plays before handing off the playbook
 	// to ansible-runner.
-	for _, play := range plays {
-		delete(play.Vars, "insights_signature")
-		delete(play.Vars, "insights_signature_exclude")
+	lines := strings.SplitAfter(string(data), "\n")
+	for _, doc := range file.Docs {
+		seq, ok := doc.Body.(*ast.SequenceNode)
+		if !ok {
+			continue
+		}
+		for _, play := range seq.Values {
+			varsPair := findMappingValue(play, "vars")
+			if varsPair == nil {
+				continue
+			}
+			if err := stripSignatureVars(lines, varsPair); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	playbookData, err := yaml.MarshalWithOptions(plays, yaml.IndentSequence(false))
-	if err != nil {
-		return nil, fmt.Errorf("cannot marshal playbook: %v", err)
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// stripSignatureVars removes the signature variables from the value of
+// varsPair by editing lines in place. Lines are cleared rather than deleted
+// so that the line numbers in the syntax tree remain valid.
+func stripSignatureVars(lines []string, varsPair *ast.MappingValueNode) error {
+	value := varsPair.Value
+	anchor, isAnchor := value.(*ast.AnchorNode)
+	if isAnchor {
+		value = anchor.Value
 	}
 
-	return playbookData, nil
+	var vars *ast.MappingNode
+	switch v := value.(type) {
+	case *ast.MappingNode:
+		vars = v
+	case *ast.MappingValueNode:
+		vars = &ast.MappingNode{Values: []*ast.MappingValueNode{v}}
+	default:
+		// vars is empty, an alias or not a mapping; there is nothing to strip.
+		return nil
+	}
+
+	var kept []*ast.MappingValueNode
+	var stripped []*ast.MappingValueNode
+	for _, pair := range vars.Values {
+		if slices.Contains(signatureVars, pair.Key.GetToken().Value) {
+			stripped = append(stripped, pair)
+		} else {
+			kept = append(kept, pair)
+		}
+	}
+	if len(stripped) == 0 {
+		return nil
+	}
+
+	if vars.IsFlowStyle {
+		// Rewrite a flow style mapping (vars: {a: 1, b: 2}) in place with
+		// only the remaining variables.
+		start := vars.Start.Position
+		end := vars.End.Position
+		if start.Line != end.Line {
+			return fmt.Errorf(
+				"cannot strip signature: multi-line flow style vars are not supported: line=%v",
+				start.Line,
+			)
+		}
+		// Each entry's original text runs from its key to the start of the
+		// next entry's key, or to the closing brace.
+		line := []rune(lines[start.Line-1])
+		var items []string
+		for i, pair := range vars.Values {
+			from := pair.Key.GetToken().Position.Column - 1
+			to := end.Column - 1
+			if i+1 < len(vars.Values) {
+				to = vars.Values[i+1].Key.GetToken().Position.Column - 1
+			}
+			if slices.Contains(kept, pair) {
+				item := strings.TrimSpace(string(line[from:to]))
+				items = append(items, strings.TrimSpace(strings.TrimSuffix(item, ",")))
+			}
+		}
+		lines[start.Line-1] = string(line[:start.Column-1]) +
+			"{" + strings.Join(items, ", ") + "}" +
+			string(line[end.Column:])
+		return nil
+	}
+
+	for _, pair := range stripped {
+		token := pair.Key.GetToken()
+		first := token.Position.Line - 1
+		last := blockEnd(lines, first, token.Position.Column-1)
+		for i := first; i < last; i++ {
+			lines[i] = ""
+		}
+	}
+
+	// Leave an explicitly empty mapping behind rather than a null value if
+	// the signature variables were the only variables.
+	if len(kept) == 0 {
+		insertAt := varsPair.Start.Position
+		insertAfter := 1
+		if isAnchor && anchor.Start.Position.Line == insertAt.Line {
+			insertAt = anchor.Start.Position
+			insertAfter = len([]rune("&" + anchor.Name.GetToken().Value))
+		}
+		line := []rune(lines[insertAt.Line-1])
+		column := insertAt.Column - 1 + insertAfter
+		lines[insertAt.Line-1] = string(line[:column]) + " {}" + string(line[column:])
+	}
+
+	return nil
+}
+
+// blockEnd returns the index of the line after the last line belonging to the
+// block style mapping entry whose key begins on lines[first] at indent. An
+// entry continues for as long as lines are blank or indented further than its
+// key. Trailing blank lines are left to the following entry.
+func blockEnd(lines []string, first int, indent int) int {
+	last := first + 1
+	for i := first + 1; i < len(lines); i++ {
+		trimmed := strings.TrimLeft(lines[i], " ")
+		if strings.TrimSpace(trimmed) == "" {
+			continue
+		}
+		lineIndent := len(lines[i]) - len(trimmed)
+		isSequenceEntry := trimmed[0] == '-' && (len(trimmed) == 1 || trimmed[1] == ' ' || trimmed[1] == '\n')
+		if lineIndent > indent || (lineIndent == indent && isSequenceEntry) {
+			last = i + 1
+			continue
+		}
+		break
+	}
+	return last
+}
+
+// findMappingValue returns the entry with the given key in node, or nil if
+// node is not a mapping or does not contain key.
+func findMappingValue(node ast.Node, key string) *ast.MappingValueNode {
+	var pairs []*ast.MappingValueNode
+	switch n := node.(type) {
+	case *ast.MappingNode:
+		pairs = n.Values
+	case *ast.MappingValueNode:
+		pairs = []*ast.MappingValueNode{n}
+	}
+	for _, pair := range pairs {
+		if pair.Key.GetToken().Value == key {
+			return pair
+		}
+	}
+	return nil
 }
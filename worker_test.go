@@ -1,14 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/goccy/go-yaml"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/ansible"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/config"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/constants"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/history"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/queue"
+	"github.com/redhatinsights/rhc-worker-playbook/internal/verify"
 )
 
 func readFile(t *testing.T, file string) []byte {
@@ -80,7 +99,7 @@ func TestVerifyPlaybook(t *testing.T) {
 		t.Run(test.description, func(t *testing.T) {
 
 			slog.SetLogLoggerLevel(slog.LevelDebug)
-			got, err := verifyPlaybook(test.input.playbook)
+			got, _, err := verifyPlaybook(test.input.playbook)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -92,6 +111,64 @@ func TestVerifyPlaybook(t *testing.T) {
 	}
 }
 
+func TestVerifyPlaybookNative(t *testing.T) {
+	backend, keyringDir := config.DefaultConfig.VerifyBackend, config.DefaultConfig.VerifyKeyringDir
+	t.Cleanup(func() {
+		config.DefaultConfig.VerifyBackend, config.DefaultConfig.VerifyKeyringDir = backend, keyringDir
+	})
+	config.DefaultConfig.VerifyBackend = config.VerifyBackendNative
+	config.DefaultConfig.VerifyKeyringDir = "./testdata/keyring"
+
+	playbook := readFile(t, "./testdata/insights_remove_test_key.yml")
+
+	tests := []struct {
+		description string
+		input       []byte
+		wantError   bool
+	}{
+		{
+			description: "signed",
+			input:       playbook,
+		},
+		{
+			description: "tampered",
+			input: bytes.Replace(
+				playbook,
+				[]byte("insights-client --disable-schedule"),
+				[]byte("insights-client --unregister"),
+				1,
+			),
+			wantError: true,
+		},
+		{
+			description: "untrusted key",
+			input:       readFile(t, "./testdata/insights_remove.yml"),
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, fingerprints, err := verifyPlaybook(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.input) {
+				t.Errorf("\ngot:\n%v\nwant:\n%v", string(got), string(test.input))
+			}
+			if len(fingerprints) != 1 {
+				t.Errorf("got %v fingerprints, want 1", len(fingerprints))
+			}
+		})
+	}
+}
+
 func TestYAMLCustomUnmarshaler(t *testing.T) {
 
 	// initialize bool pointers for comparison
@@ -408,20 +485,22 @@ func TestStripSignature(t *testing.T) {
     - ping:
 `)
 
-		// should be the input but with the signature stripped
-		// the "become" boolean should also be set to strictly true/false
-		want := []byte(`- name: Insights Disable
+		// should be the input, byte for byte, with only the signature
+		// variables stripped
+		want := []byte(`# This playbook will take care of all steps required to disable
+# Insights Client
+- name: Insights Disable
   hosts: localhost
-  become: true
+  become: yes
   vars: {}
   tasks:
-  - name: Disable the insights-client
-    command: insights-client --disable-schedule
+    - name: Disable the insights-client
+      command: insights-client --disable-schedule
 - name: ping
   hosts: localhost
   vars: {}
   tasks:
-  - ping: null
+    - ping:
 `)
 
 		got, err := stripSignature(playbook)
@@ -433,6 +512,112 @@ func TestStripSignature(t *testing.T) {
 		}
 	})
 
+	t.Run("stripSignature preserves play keywords, comments and anchors", func(t *testing.T) {
+		playbook := []byte(`- name: Update packages
+  hosts: localhost
+  gather_facts: false
+  become: true
+  become_user: root
+  serial: 1
+  vars: &common
+    # the package to update
+    package: httpd
+    insights_signature_exclude: /hosts,/vars/insights_signature
+    insights_signature: !!binary |
+      TFMwdExTMUNSVWRKVGlCUVIxQWdVMGxIVGtGVVZWSkZMUzB0TFMwS1ZtVnljMmx2YmpvZ1IyNTFV
+
+      RWNnZGpFS0NtbFJTV05DUVVGQ1EwRkJSMEpSU20xdGIwRmtRVUZ2U2tWTmRuYzFPRVFyYWpWd1Rr
+    restart: true
+  environment:
+    LANG: C
+  pre_tasks:
+    - ping:
+  tasks:
+    - name: Update {{ package }}
+      ansible.builtin.dnf:
+        name: "{{ package }}"
+        state: latest
+      notify: restart
+  handlers:
+    - name: restart
+      ansible.builtin.service:
+        name: "{{ package }}"
+        state: restarted
+- name: Report
+  hosts: localhost
+  vars: {insights_signature_exclude: /hosts, insights_signature: abc, verbose: true}
+  roles:
+    - report
+`)
+
+		want := []byte(`- name: Update packages
+  hosts: localhost
+  gather_facts: false
+  become: true
+  become_user: root
+  serial: 1
+  vars: &common
+    # the package to update
+    package: httpd
+    restart: true
+  environment:
+    LANG: C
+  pre_tasks:
+    - ping:
+  tasks:
+    - name: Update {{ package }}
+      ansible.builtin.dnf:
+        name: "{{ package }}"
+        state: latest
+      notify: restart
+  handlers:
+    - name: restart
+      ansible.builtin.service:
+        name: "{{ package }}"
+        state: restarted
+- name: Report
+  hosts: localhost
+  vars: {verbose: true}
+  roles:
+    - report
+`)
+
+		got, err := stripSignature(playbook)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(got, want) {
+			t.Errorf("\ngot:\n%v\nwant:\n%v", string(got), string(want))
+		}
+	})
+
+	t.Run("stripSignature leaves an anchored empty vars mapping", func(t *testing.T) {
+		playbook := []byte(`- name: ping
+  hosts: localhost
+  vars: &empty # no other variables
+    insights_signature_exclude: /hosts,/vars/insights_signature
+    insights_signature: !!binary |
+      TFMwdExTMUNSVWRKVGlCUVIxQWdVMGxIVGtGVVZWSkZMUzB0TFMwS1ZtVnljMmx2YmpvZ1IyNTFV
+  tasks:
+    - ping:
+`)
+
+		want := []byte(`- name: ping
+  hosts: localhost
+  vars: &empty {} # no other variables
+  tasks:
+    - ping:
+`)
+
+		got, err := stripSignature(playbook)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(got, want) {
+			t.Errorf("\ngot:\n%v\nwant:\n%v", string(got), string(want))
+		}
+	})
+
 	t.Run("stripSignature returns an error when given invalid YAML", func(t *testing.T) {
 
 		got, err := stripSignature([]byte(`401 Unauthorized`))
@@ -444,3 +629,698 @@ func TestStripSignature(t *testing.T) {
 		}
 	})
 }
+
+func TestParseExtraVars(t *testing.T) {
+	allowlist := []string{"package_name", "reboot"}
+
+	tests := []struct {
+		description string
+		input       string
+		want        map[string]any
+		wantError   bool
+	}{
+		{
+			description: "allowed variables",
+			input:       `{"package_name": "httpd", "reboot": false}`,
+			want:        map[string]any{"package_name": "httpd", "reboot": false},
+		},
+		{
+			description: "variable not in allowlist",
+			input:       `{"package_name": "httpd", "hosts": "all"}`,
+			wantError:   true,
+		},
+		{
+			description: "reserved signature variable",
+			input:       `{"insights_signature_exclude": "/hosts"}`,
+			wantError:   true,
+		},
+		{
+			description: "invalid JSON",
+			input:       `package_name=httpd`,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseExtraVars(test.input, allowlist)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected an error, got: %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("\ngot:\n%v\nwant:\n%v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseExecutionTimeout(t *testing.T) {
+	tests := []struct {
+		description string
+		input       map[string]string
+		want        time.Duration
+		wantError   bool
+	}{
+		{
+			description: "missing",
+			input:       map[string]string{},
+			want:        config.DefaultConfig.ExecutionTimeout,
+		},
+		{
+			description: "seconds",
+			input:       map[string]string{"timeout": "90"},
+			want:        90 * time.Second,
+		},
+		{
+			description: "zero",
+			input:       map[string]string{"timeout": "0"},
+			wantError:   true,
+		},
+		{
+			description: "negative",
+			input:       map[string]string{"timeout": "-30"},
+			wantError:   true,
+		},
+		{
+			description: "invalid",
+			input:       map[string]string{"timeout": "soon"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseExecutionTimeout(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got: %v want: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompressEvents(t *testing.T) {
+	tests := []struct {
+		description string
+		input       map[string]string
+		want        bool
+	}{
+		{
+			description: "missing",
+			input:       map[string]string{},
+			want:        false,
+		},
+		{
+			description: "gzip",
+			input:       map[string]string{"accept_encoding": "gzip"},
+			want:        true,
+		},
+		{
+			description: "list",
+			input:       map[string]string{"accept_encoding": "br, GZIP"},
+			want:        true,
+		},
+		{
+			description: "unsupported",
+			input:       map[string]string{"accept_encoding": "br"},
+			want:        false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := compressEvents(test.input)
+			if got != test.want {
+				t.Errorf("got: %v want: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseEventSelection(t *testing.T) {
+	tests := []struct {
+		description string
+		input       map[string]string
+		want        ansible.EventSelection
+		wantError   bool
+	}{
+		{
+			description: "configuration",
+			input:       map[string]string{},
+			want: ansible.EventSelection{
+				Preset:  config.DefaultConfig.EventPreset,
+				Include: config.DefaultConfig.EventInclude,
+				Exclude: config.DefaultConfig.EventExclude,
+			},
+		},
+		{
+			description: "metadata override",
+			input: map[string]string{
+				"event_preset":  "failures-only",
+				"event_include": "playbook_on_start, playbook_on_play_start",
+				"event_exclude": "",
+			},
+			want: ansible.EventSelection{
+				Preset:  "failures-only",
+				Include: []string{"playbook_on_start", "playbook_on_play_start"},
+			},
+		},
+		{
+			description: "unknown preset",
+			input:       map[string]string{"event_preset": "verbose"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseEventSelection(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected an error, got: %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWritePlayReport(t *testing.T) {
+	tests := []struct {
+		description string
+		input       verify.PlayReport
+		want        string
+	}{
+		{
+			description: "verified",
+			input: verify.PlayReport{
+				Index:       0,
+				Name:        "Update packages",
+				Exclusions:  []string{"/hosts", "/vars/insights_signature"},
+				KeyID:       "199E2F91FD431D51",
+				Fingerprint: "567E347AD0044ADE55BA8A5F199E2F91FD431D51",
+				Signed:      "{'name': 'Update packages'}",
+			},
+			want: `play 0 "Update packages": verified
+  key ID:         199E2F91FD431D51
+  fingerprint:    567E347AD0044ADE55BA8A5F199E2F91FD431D51
+  excluded paths: /hosts, /vars/insights_signature
+  signed content: {'name': 'Update packages'}
+`,
+		},
+		{
+			description: "failed",
+			input: verify.PlayReport{
+				Index: 1,
+				Err:   errors.New("missing variable: insights_signature"),
+			},
+			want: `play 1 "": FAILED: missing variable: insights_signature
+  key ID:         (none)
+  fingerprint:    (none)
+  excluded paths: (none)
+  signed content: (none)
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := &strings.Builder{}
+			writePlayReport(got, test.input)
+			if got.String() != test.want {
+				t.Errorf("\ngot:\n%v\nwant:\n%v", got.String(), test.want)
+			}
+		})
+	}
+}
+
+// fakeTransmitter records the name of every event it is asked to transmit
+// and accepts them all.
+type fakeTransmitter struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (f *fakeTransmitter) Transmit(
+	addr string,
+	id string,
+	responseTo string,
+	metadata map[string]string,
+	data []byte,
+) (int, map[string]string, []byte, error) {
+	_, params, err := mime.ParseMediaType(metadata["Content-Type"])
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	part, err := multipart.NewReader(bytes.NewReader(data), params["boundary"]).NextPart()
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	content, err := io.ReadAll(part)
+	if err != nil {
+		return -1, nil, nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var event struct {
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			return -1, nil, nil, err
+		}
+		if event.Event != "executor_on_heartbeat" {
+			f.events = append(f.events, event.Event)
+		}
+	}
+	return http.StatusAccepted, map[string]string{}, nil, nil
+}
+
+// fakeAnsibleRunner replaces the python3 interpreter running ansible-runner
+// with a script that records status and rc in the artifacts of the run, then
+// exits with rc.
+func fakeAnsibleRunner(t *testing.T, status string, rc int) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "python3")
+	data := fmt.Sprintf(`#!/bin/sh
+ident=$5
+for dir; do :; done
+mkdir -p "$dir/artifacts/$ident"
+printf %%s %v > "$dir/artifacts/$ident/status"
+printf %%s %v > "$dir/artifacts/$ident/rc"
+exit %v
+`, status, rc, rc)
+	if err := os.WriteFile(script, []byte(data), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	python3Path, stateDir, privateDataDir := constants.Python3Path, constants.StateDir, constants.PrivateDataDir
+	t.Cleanup(func() {
+		constants.Python3Path, constants.StateDir, constants.PrivateDataDir = python3Path, stateDir, privateDataDir
+	})
+	constants.Python3Path = script
+	constants.StateDir = dir
+	constants.PrivateDataDir = filepath.Join(dir, "runs")
+}
+
+func TestRx(t *testing.T) {
+	tests := []struct {
+		description string
+		metadata    map[string]string
+		status      string
+		rc          int
+		wantError   bool
+		wantEvents  []string
+		wantRun     history.Run
+	}{
+		{
+			description: "successful",
+			status:      "successful",
+			wantEvents:  []string{"executor_on_start", "executor_on_complete"},
+			wantRun: history.Run{
+				Verification:    history.VerificationDisabled,
+				Status:          "successful",
+				TransmitOutcome: ansible.TransmitAcknowledged,
+			},
+		},
+		{
+			description: "failed",
+			status:      "failed",
+			rc:          2,
+			wantError:   true,
+			wantEvents:  []string{"executor_on_start", "executor_on_complete", "executor_on_failed"},
+			wantRun: history.Run{
+				Verification:    history.VerificationDisabled,
+				Status:          "failed",
+				ErrorKey:        "UNDEFINED_ERROR",
+				TransmitOutcome: ansible.TransmitAcknowledged,
+			},
+		},
+		{
+			description: "invalid check_mode",
+			metadata:    map[string]string{"check_mode": "maybe"},
+			wantError:   true,
+			wantEvents:  []string{"executor_on_start", "executor_on_failed"},
+			wantRun: history.Run{
+				Verification:    history.VerificationDisabled,
+				ErrorKey:        "ANSIBLE_PLAYBOOK_OPTIONS_VALIDATION_FAILED",
+				TransmitOutcome: ansible.TransmitAcknowledged,
+			},
+		},
+		{
+			description: "invalid diff",
+			metadata:    map[string]string{"diff": "maybe"},
+			wantError:   true,
+			wantEvents:  []string{"executor_on_start", "executor_on_failed"},
+			wantRun: history.Run{
+				Verification:    history.VerificationDisabled,
+				ErrorKey:        "ANSIBLE_PLAYBOOK_OPTIONS_VALIDATION_FAILED",
+				TransmitOutcome: ansible.TransmitAcknowledged,
+			},
+		},
+		{
+			description: "invalid crc_message_version",
+			metadata:    map[string]string{"crc_message_version": "two"},
+			wantError:   true,
+			wantEvents:  []string{"executor_on_start", "executor_on_failed"},
+			wantRun: history.Run{
+				Verification:    history.VerificationDisabled,
+				ErrorKey:        "ANSIBLE_PLAYBOOK_OPTIONS_VALIDATION_FAILED",
+				TransmitOutcome: ansible.TransmitAcknowledged,
+			},
+		},
+		{
+			description: "unsupported crc_message_version",
+			metadata:    map[string]string{"crc_message_version": "99"},
+			wantError:   true,
+			wantEvents:  []string{"executor_on_start", "executor_on_failed"},
+			wantRun: history.Run{
+				Verification:    history.VerificationDisabled,
+				ErrorKey:        "ANSIBLE_PLAYBOOK_OPTIONS_VALIDATION_FAILED",
+				TransmitOutcome: ansible.TransmitAcknowledged,
+			},
+		},
+		{
+			description: "invalid event_preset",
+			metadata:    map[string]string{"event_preset": "verbose"},
+			wantError:   true,
+			wantEvents:  []string{"executor_on_start", "executor_on_failed"},
+			wantRun: history.Run{
+				Verification:    history.VerificationDisabled,
+				ErrorKey:        "ANSIBLE_EVENT_SELECTION_VALIDATION_FAILED",
+				TransmitOutcome: ansible.TransmitAcknowledged,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			fakeAnsibleRunner(t, test.status, test.rc)
+
+			defaultConfig := config.DefaultConfig
+			savedQueue, savedOutboxDir, savedHistory, savedTransmitter := runQueue, outboxDir, runHistory, transmitter
+			t.Cleanup(func() {
+				config.DefaultConfig = defaultConfig
+				runQueue, outboxDir, runHistory, transmitter = savedQueue, savedOutboxDir, savedHistory, savedTransmitter
+			})
+			config.DefaultConfig.VerifyPlaybook = false
+			config.DefaultConfig.PolicyFile = filepath.Join(t.TempDir(), "policy.toml")
+
+			var err error
+			runQueue, err = queue.New(t.TempDir(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outboxDir = t.TempDir()
+			runHistory, err = history.Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			fake := &fakeTransmitter{}
+			transmitter = fake
+
+			metadata := map[string]string{
+				"return_url":                    "https://example.com/api/v1/processor",
+				"crc_dispatcher_correlation_id": "correlation",
+				"response_interval":             "1",
+			}
+			for key, value := range test.metadata {
+				metadata[key] = value
+			}
+			data := []byte("- hosts: localhost\n  tasks: []\n")
+			err = rx(nil, "rhc_worker_playbook", "message", "", metadata, data)
+			if test.wantError && err == nil {
+				t.Error("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if !cmp.Equal(fake.events, test.wantEvents) {
+				t.Errorf("\ngot:\n%v\nwant:\n%v", fake.events, test.wantEvents)
+			}
+
+			got, err := runHistory.Get("message")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.wantRun
+			want.MessageID = "message"
+			want.CorrelationID = "correlation"
+			want.ReturnURL = metadata["return_url"]
+			want.PlaybookSHA256 = fmt.Sprintf("%x", sha256.Sum256(data))
+			if !cmp.Equal(got, want, cmpopts.IgnoreFields(history.Run{}, "Started", "Finished")) {
+				t.Errorf("run record mismatch (-got +want):\n%v", cmp.Diff(got, want, cmpopts.IgnoreFields(history.Run{}, "Started", "Finished")))
+			}
+			if got.Finished.Before(got.Started) {
+				t.Errorf("run finished before it started: started=%v finished=%v", got.Started, got.Finished)
+			}
+
+			if _, has := runQueue.Interrupted(); has || len(runQueue.Restored()) > 0 {
+				t.Error("message should be removed from the run queue")
+			}
+		})
+	}
+}
+
+func TestVerifyLocalPlaybook(t *testing.T) {
+	backend, keyringDir := config.DefaultConfig.VerifyBackend, config.DefaultConfig.VerifyKeyringDir
+	t.Cleanup(func() {
+		config.DefaultConfig.VerifyBackend, config.DefaultConfig.VerifyKeyringDir = backend, keyringDir
+	})
+
+	emptyKeyringDir := t.TempDir()
+	tests := []struct {
+		description string
+		backend     string
+		keyringDir  string
+		wantOutput  string
+		wantError   string
+	}{
+		{
+			description: "native",
+			backend:     config.VerifyBackendNative,
+			keyringDir:  "./testdata/keyring",
+			wantOutput:  `play 0 "Insights Disable": verified`,
+		},
+		{
+			description: "native without keys",
+			backend:     config.VerifyBackendNative,
+			keyringDir:  emptyKeyringDir,
+			wantError:   config.FlagNameVerifyKeyringDir + "=" + emptyKeyringDir,
+		},
+		{
+			description: "subprocess without keys",
+			backend:     config.VerifyBackendSubprocess,
+			keyringDir:  emptyKeyringDir,
+			wantError:   config.FlagNameVerifyKeyringDir + "=" + emptyKeyringDir,
+		},
+		{
+			description: "unknown backend",
+			backend:     "gpg",
+			keyringDir:  "./testdata/keyring",
+			wantError:   "unknown verification backend gpg",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			config.DefaultConfig.VerifyBackend = test.backend
+			config.DefaultConfig.VerifyKeyringDir = test.keyringDir
+
+			got := &strings.Builder{}
+			err := verifyLocalPlaybook(got, readFile(t, "./testdata/insights_remove_test_key.yml"))
+			if !strings.Contains(got.String(), test.wantOutput) {
+				t.Errorf("\ngot:\n%v\nwant:\n%v", got.String(), test.wantOutput)
+			}
+			if test.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantError) {
+					t.Errorf("got error %v, want an error containing %q", err, test.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestVerifyLocalPlaybookSubprocess(t *testing.T) {
+	backend, keyringDir := config.DefaultConfig.VerifyBackend, config.DefaultConfig.VerifyKeyringDir
+	t.Cleanup(func() {
+		config.DefaultConfig.VerifyBackend, config.DefaultConfig.VerifyKeyringDir = backend, keyringDir
+	})
+	config.DefaultConfig.VerifyBackend = config.VerifyBackendSubprocess
+	config.DefaultConfig.VerifyKeyringDir = "./testdata/keyring"
+
+	// The report of each play is written whether or not rhc-playbook-verifier
+	// accepts the playbook, which it does not here since the playbook is
+	// signed by a test key.
+	got := &strings.Builder{}
+	err := verifyLocalPlaybook(got, readFile(t, "./testdata/insights_remove_test_key.yml"))
+	if err == nil {
+		t.Error("expected error")
+	}
+	for _, want := range []string{
+		`play 0 "Insights Disable": verified`,
+		"  excluded paths: ",
+		"  signed content: ",
+		"rhc-playbook-verifier: FAILED: ",
+	} {
+		if !strings.Contains(got.String(), want) {
+			t.Errorf("\ngot:\n%v\nwant:\n%v", got.String(), want)
+		}
+	}
+}
+
+func TestApplyRetentionRecords(t *testing.T) {
+	now := time.Now()
+	records := []history.Run{
+		{
+			// Rejected before its playbook was written.
+			MessageID:     "rejected",
+			CorrelationID: "correlation-rejected",
+			Started:       now.Add(-72 * time.Hour),
+			Finished:      now.Add(-72 * time.Hour),
+			ErrorKey:      "ANSIBLE_PLAYBOOK_POLICY_VIOLATION",
+		},
+		{
+			MessageID:     "old",
+			CorrelationID: "correlation-old",
+			Started:       now.Add(-49 * time.Hour),
+			Finished:      now.Add(-48 * time.Hour),
+			Status:        "successful",
+		},
+		{
+			MessageID:     "recent",
+			CorrelationID: "correlation-recent",
+			Started:       now.Add(-2 * time.Hour),
+			Finished:      now.Add(-time.Hour),
+			Status:        "failed",
+		},
+		{
+			MessageID:     "latest",
+			CorrelationID: "correlation-latest",
+			Started:       now.Add(-time.Minute),
+			Finished:      now,
+			Status:        "successful",
+		},
+	}
+
+	tests := []struct {
+		description string
+		maxAge      time.Duration
+		maxRuns     int
+		active      []string
+		want        []string
+	}{
+		{
+			description: "disabled",
+			want:        []string{"rejected", "old", "recent", "latest"},
+		},
+		{
+			description: "max age",
+			maxAge:      24 * time.Hour,
+			want:        []string{"recent", "latest"},
+		},
+		{
+			description: "max runs",
+			maxRuns:     1,
+			want:        []string{"latest"},
+		},
+		{
+			description: "active run",
+			maxRuns:     1,
+			active:      []string{"correlation-old"},
+			want:        []string{"old", "latest"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			defaultConfig := config.DefaultConfig
+			savedHistory := runHistory
+			stateDir, privateDataDir := constants.StateDir, constants.PrivateDataDir
+			t.Cleanup(func() {
+				config.DefaultConfig = defaultConfig
+				runHistory = savedHistory
+				constants.StateDir, constants.PrivateDataDir = stateDir, privateDataDir
+			})
+			config.DefaultConfig.RetentionMaxAge = test.maxAge
+			config.DefaultConfig.RetentionMaxRuns = test.maxRuns
+			constants.StateDir = t.TempDir()
+			constants.PrivateDataDir = filepath.Join(constants.StateDir, "runs")
+
+			var err error
+			runHistory, err = history.Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, record := range records {
+				if err := runHistory.Save(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			applyRetention(test.active)
+
+			remaining, err := runHistory.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, record := range remaining {
+				got = append(got, record.MessageID)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("\ngot:\n%v\nwant:\n%v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCorrelationIdPattern(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{input: "8b5c5b2e-4d0a-4c8f-9d0e-1f2a3b4c5d6e", want: true},
+		{input: "run_1.2", want: true},
+		{input: "", want: false},
+		{input: "..", want: false},
+		{input: "../outbox", want: false},
+		{input: "x -e ansible_become=true -e y", want: false},
+		{input: "x'y", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got := correlationIdPattern.MatchString(test.input)
+			if got != test.want {
+				t.Errorf("got: %v want: %v", got, test.want)
+			}
+		})
+	}
+}